@@ -1,29 +1,36 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 )
 
 const (
 	apodPageURL    = "https://apod.nasa.gov/apod/ap%s.html"
-	apodAPIURL     = "https://api.nasa.gov/planetary/apod?api_key=DEMO_KEY&date=%s"
+	apodAPIURL     = "https://api.nasa.gov/planetary/apod?api_key=DEMO_KEY&thumbs=True&date=%s"
 	apodSiteURL    = "https://apod.nasa.gov/apod/"
 	mediaTypeImage = "image"
 	mediaTypeVideo = "video"
+	mediaTypeOther = "other" // interactive or unusual content, API may omit url
+	commandPost    = "post"
+	commandUpdate  = "update"
+	commandRetract = "retract"
 )
 
 func makeAPIRequest(currentTime time.Time) (io.ReadCloser, error) {
 	currentDate := currentTime.Format("2006-01-02")
 	apiURL := fmt.Sprintf(apodAPIURL, currentDate)
-	resp, err := http.Get(apiURL)
+	resp, err := httpGet(apiURL)
 	if err != nil {
 		return nil, err
 	}
@@ -40,7 +47,7 @@ func makeAPIRequest(currentTime time.Time) (io.ReadCloser, error) {
 func makeHTMLRequest(currentTime time.Time) (io.ReadCloser, error) {
 	currentDate := currentTime.Format("060102")
 	url := fmt.Sprintf(apodPageURL, currentDate)
-	resp, err := http.Get(url)
+	resp, err := httpGet(url)
 	if err != nil {
 		return nil, err
 	}
@@ -54,15 +61,15 @@ func makeHTMLRequest(currentTime time.Time) (io.ReadCloser, error) {
 	return resp.Body, nil
 }
 
-func pictureURL(p picture) string {
+func pictureURL(p picture, requestTime time.Time) string {
 	const dateFormat = "060102"
 	pictureTime, err := time.Parse("2006-01-02", p.Date)
 	if err != nil {
 		logError(err)
 	}
 	pictureDate := pictureTime.Format(dateFormat)
-	if pictureDate != time.Now().Format(dateFormat) {
-		logError("Picture's date doesn't match the current date:", pictureDate)
+	if pictureDate != requestTime.Format(dateFormat) {
+		logError("Picture's date doesn't match the requested date:", pictureDate)
 	}
 	return fmt.Sprintf(apodPageURL, pictureDate)
 }
@@ -97,85 +104,302 @@ func pictureFromAPI(p *picture, t time.Time) error {
 func pictureFromHTML(p *picture, t time.Time) error {
 	reader, err := makeHTMLRequest(t)
 	if err != nil {
-		logError(err)
+		return err
 	}
 	defer reader.Close()
 	return makePictureFromHTML(reader, p)
 }
 
+// fetchPicture tries API first and falls back to HTML page, returns used source.
+// The picture is validated, HTML page is tried if API returns an invalid one
+func fetchPicture(p *picture, t time.Time) (string, error) {
+	err := pictureFromAPI(p, t)
+	if err == nil {
+		err = p.Validate()
+	}
+	if err == nil {
+		return sourceAPI, nil
+	}
+	logWarning("Got error from API", err)
+	*p = picture{}
+	err = pictureFromHTML(p, t)
+	if err == nil {
+		err = p.Validate()
+	}
+	return sourceHTML, err
+}
+
 func main() {
 	var service, token string
 	var chatID int64
 	var err error
 	var errChatID int64
+	var storage string
+	var stateDir string
+	var recheck time.Duration
+	var dryRun bool
+	var templatesDir string
+	var translatorURL, translatorKey, translationsFile string
+	var mirrorName string
+	var apiURL string
+	var localBotAPI bool
+	var workers int
 	flag.StringVar(&token, "token", "", "bot api token")
 	flag.Int64Var(&chatID, "chat", 0, "destination chat id")
 	flag.StringVar(&service, "service", "tt", "tg or tt")
 	flag.Int64Var(&errChatID, "err_chat", 0, "chat for error notification")
+	flag.StringVar(&storage, "storage", storageJSON, "state storage: json or bolt")
+	flag.StringVar(&stateDir, "state", "", "state directory (default $"+stateEnvVariable+", $STATE_DIRECTORY or $XDG_STATE_HOME/"+stateAppName+")")
+	flag.DurationVar(&recheck, "recheck", 0, "update posted messages once if NASA changed the picture after this delay, e.g. 1h")
+	flag.BoolVar(&dryRun, "dry-run", false, "print messages instead of sending them, state isn't changed")
+	flag.StringVar(&templatesDir, "templates", "", "directory with message templates overrides (photo.tmpl, video.tmpl, video_text.tmpl, document.tmpl, other.tmpl)")
+	flag.StringVar(&captionLanguage, "lang", "", "translate captions into the language, e.g. ru")
+	flag.StringVar(&translatorURL, "translator", "", "LibreTranslate compatible API URL, e.g. http://localhost:5000")
+	flag.StringVar(&translatorKey, "translator_key", "", "translation API key")
+	flag.StringVar(&translationsFile, "translations", "", "JSON file with manual translations by date and language, they take precedence over -translator")
+	flag.StringVar(&mirrorName, "mirror", "", "take translated title and explanation from APOD mirror page URL template like https://example.com/apod/ap%s.html")
+	flag.DurationVar(&httpTransport.Timeout, "timeout", defaultHTTPTimeout, "timeout of every HTTP request attempt including uploads, it's extended by a second for every 256 KB of a file or starts when a file of unknown size is sent; response body has to keep coming within it")
+	flag.IntVar(&httpTransport.Retries, "retries", defaultHTTPRetries, "retries of failed HTTP requests")
+	flag.StringVar(&apiURL, "api_url", "", "messenger API base URL (default "+tgAPIURL+" or "+ttAPIURL+")")
+	flag.BoolVar(&localBotAPI, "local_bot_api", false, "TG API is a local telegram-bot-api server, files up to 2000 MB are uploaded")
+	flag.IntVar(&workers, "workers", defaultWorkers, "concurrent media downloads and uploads")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [post|update [-date YYYY-MM-DD]|retract -date YYYY-MM-DD]\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	if len(token) == 0 || chatID == 0 {
+	// Stop waiting for hung connections on Ctrl+C or service stop
+	var stop context.CancelFunc
+	httpContext, stop = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	command := commandPost
+	if flag.NArg() > 0 {
+		command = flag.Arg(0)
+	}
+	// retract works across all chats
+	if len(token) == 0 || (chatID == 0 && command != commandRetract) {
 		log.Fatalln("Wrong arguments")
 	}
 
+	if len(templatesDir) > 0 {
+		if service == "tg" {
+			tgTemplates, err = loadTemplates(tgTemplates, templatesDir)
+		} else {
+			ttTemplates, err = loadTemplates(ttTemplates, templatesDir)
+		}
+		if err != nil {
+			log.Fatalln("Can't load templates:", err)
+		}
+	}
+
+	if len(apiURL) > 0 {
+		if service == "tg" {
+			tgBaseURL = strings.TrimSuffix(apiURL, "/")
+		} else {
+			ttBaseURL = strings.TrimSuffix(apiURL, "/")
+		}
+	}
+	uploadPool = newWorkerPool(workers)
+	if localBotAPI {
+		tgDocumentLimits.MaxLength = tgLocalMaxFileLength
+	}
+
+	if dryRun {
+		httpTransport.Next = dryRunTransport{token, httpTransport.Next}
+	}
+
 	if errChatID != 0 {
 		if service == "tg" {
 			sendError = func(s string) error {
-				message := tgMessage{errChatID, s, ""}
-				return tgSendMessage(message, tgSendMessageTemplate, token)
+				_, err := newTGClient(token).SendMessage(tgMessage{errChatID, s, ""})
+				return err
 			}
 		} else {
 			sendError = func(s string) error {
-				url := fmt.Sprintf(ttSendMessageTemplate, token, errChatID)
-				return ttSendMessage(url, ttMessage{s, []ttMessageAttachment{}, true}, 0)
+				_, err := newTTClient(token).SendMessage(errChatID, ttMessage{s, []ttMessageAttachment{}, true})
+				return err
 			}
 		}
 	}
 
-	lastDate := readLastSentDate(service)
+	stateDir, err = stateDirectory(stateDir)
+	if err != nil {
+		logError("Can't find state directory:", err)
+	}
+	legacyStateDir, err := legacyStateDirectory()
+	if err != nil {
+		logError("Can't find executable:", err)
+	}
+	if dryRun {
+		fullConfigFilePath = filepath.Join(dryRunStateDirectory(stateDir, legacyStateDir), configFile)
+	} else {
+		err = setupStateDirectory(stateDir, legacyStateDir)
+		if err != nil {
+			logError("Can't setup state directory:", err)
+		}
+	}
+
+	var store stateStore
+	if dryRun {
+		store, err = openDryRunStore(storage)
+	} else {
+		store, err = openStore(storage)
+	}
+	if err != nil {
+		logError("Can't open state storage:", err)
+	}
+	defer store.Close()
+	if dryRun {
+		store = dryRunStore{store}
+	}
+
+	var mirror apodMirror
+	if len(mirrorName) > 0 {
+		mirror, err = findMirror(mirrorName, captionLanguage)
+		if err != nil {
+			log.Fatalln("Wrong arguments:", err)
+		}
+		captionLanguage = mirror.Language
+	}
+	if len(captionLanguage) > 0 {
+		if len(translatorURL) > 0 {
+			translator = cachedTranslator{store, service, libreTranslator{translatorURL, translatorKey}}
+		}
+		if len(mirrorName) > 0 {
+			translator = mirrorTranslator{mirror, translator}
+		}
+		if len(translationsFile) > 0 {
+			translator = overrideTranslator{translationsFile, translator}
+		}
+		if translator == nil {
+			log.Fatalln("Wrong arguments: -lang requires -translator, -translations or -mirror")
+		}
+	}
+
+	commandFlags := flag.NewFlagSet(command, flag.ExitOnError)
+	date := commandFlags.String("date", "", "APOD date in YYYY-MM-DD format, the latest delivery by default")
+	if flag.NArg() > 0 {
+		commandFlags.Parse(flag.Args()[1:])
+	}
+
+	switch command {
+	case commandPost:
+		err = post(store, service, token, chatID, recheck)
+	case commandUpdate:
+		err = update(store, service, token, chatID, *date)
+	case commandRetract:
+		err = retract(store, service, token, *date)
+	default:
+		log.Fatalln("Unknown command", command)
+	}
+	if err != nil {
+		logError(strings.ToUpper(service), err)
+	}
+}
+
+func post(store stateStore, service string, token string, chatID int64, recheck time.Duration) error {
+	lastDate, err := readLastSentDate(store, service)
+	if err != nil {
+		logError("Refusing to post, can't read state:", err)
+	}
 	fmt.Println("Last sent date:", lastDate)
 
 	currentTime := time.Now()
 	currentDate := currentTime.Format("2006-01-02")
 	if lastDate == currentDate {
+		if recheck > 0 {
+			return recheckLatest(store, service, chatID, recheck, token)
+		}
 		fmt.Println("Nothing to do")
-		return
+		return nil
 	}
 
 	var item picture
-	// try to get data from API first
-	err = pictureFromAPI(&item, currentTime)
+	source, err := fetchPicture(&item, currentTime)
 	if err != nil {
-		logWarning("Got error from API", err)
-		err = pictureFromHTML(&item, currentTime)
-		if err != nil {
-			logError(err)
-		}
+		logError(err)
 	}
-	item.Link = pictureURL(item)
+	item.Link = pictureURL(item, currentTime)
 
-	var send func(picture, string, int64) error
+	// Media type is validated by fetchPicture
+	var send func(picture, string, int64) ([]sentMessage, error)
 	if service == "tg" {
-		if item.MediaType == mediaTypeImage {
+		switch item.MediaType {
+		case mediaTypeImage:
 			send = tgSendPicture
-		} else if item.MediaType == mediaTypeVideo {
+		case mediaTypeVideo:
 			send = tgSendVideo
-		} else {
-			logError("Unsupported TG media_type", item.MediaType)
+		default:
+			send = tgSendOther
 		}
 	} else {
-		if item.MediaType == mediaTypeImage {
+		switch item.MediaType {
+		case mediaTypeImage:
 			send = ttSendPicture
-		} else if item.MediaType == mediaTypeVideo {
+		case mediaTypeVideo:
 			send = ttSendVideo
-		} else {
-			logError("Unsupported TT media_type", item.MediaType)
+		default:
+			send = ttSendOther
 		}
 	}
-	err = send(item, token, chatID)
+	delivery := Delivery{
+		Date:      currentDate,
+		Service:   service,
+		Chat:      chatID,
+		Source:    source,
+		StartedAt: currentTime,
+		Picture:   item,
+	}
+	return deliver(store, delivery, send, token)
+}
+
+// deliver sends the picture and saves the delivery even if only some messages were sent,
+// so they can be retracted and the date isn't posted twice
+func deliver(store stateStore, delivery Delivery, send func(picture, string, int64) ([]sentMessage, error), token string) error {
+	// Delivery keeps the original picture to detect NASA edits
+	translated := translatePicture(delivery.Picture)
+	messages, err := send(translated, token, delivery.Chat)
+	if migratedChat := tgMigratedChat(err); migratedChat != 0 && len(messages) == 0 {
+		logWarning("TG: Group", delivery.Chat, "was upgraded to supergroup", migratedChat, "update -chat")
+		delivery.Chat = migratedChat
+		messages, err = send(translated, token, delivery.Chat)
+	}
+	if err != nil && len(messages) == 0 {
+		return err
+	}
+
+	delivery.SentAt = time.Now()
+	delivery.Partial = err != nil
+	for _, message := range messages {
+		delivery.MessageIDs = append(delivery.MessageIDs, message.ID)
+		delivery.MessageKinds = append(delivery.MessageKinds, message.Kind)
+	}
+	saveErr := saveDelivery(store, delivery)
+	if saveErr != nil {
+		logError("Can't save state:", saveErr)
+	}
 	if err != nil {
-		logError(strings.ToUpper(service), err)
+		return fmt.Errorf("Posted partially, retract %s and post again: %w", delivery.Date, err)
 	}
+	return nil
+}
 
-	saveCurrentDate(service, currentDate)
+func update(store stateStore, service string, token string, chatID int64, date string) error {
+	deliveries, err := findDeliveries(store, service, chatID, date)
+	if err != nil {
+		return err
+	}
+	if len(deliveries) == 0 {
+		return errors.New("Nothing was posted to the chat " + date)
+	}
+	tasks := make([]func() error, len(deliveries))
+	for i, delivery := range deliveries {
+		delivery := delivery
+		tasks[i] = func() error {
+			return updateDelivery(store, delivery, token)
+		}
+	}
+	return deliveryPool(service).Run(tasks...)
 }
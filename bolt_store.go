@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const boltFile = "status.db"
+
+var (
+	boltStateBucket       = []byte("state")
+	boltHistoryBucket     = []byte("history")
+	boltTranslationBucket = []byte("translations")
+)
+
+// boltStore keeps state in an embedded bbolt database:
+// state/<service> is service Config without history,
+// history/<service>/<sequence> is a Delivery,
+// translations/<service>/<date>/<language> is a Translation.
+// The database is opened for every transaction, so its file lock isn't held
+// while posting and concurrent runs for other services don't wait
+type boltStore struct {
+	path string
+	// mutex serializes transactions within the process, file lock is per open database
+	mutex sync.Mutex
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+// boltOpenTimeout is how long a transaction waits for another process
+const boltOpenTimeout = time.Minute
+
+func openBoltStore(filePath string) (*boltStore, error) {
+	store := &boltStore{path: filePath}
+	err := store.open(false, func(db *bolt.DB) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(boltStateBucket)
+			if err != nil {
+				return err
+			}
+			_, err = tx.CreateBucketIfNotExists(boltHistoryBucket)
+			if err != nil {
+				return err
+			}
+			_, err = tx.CreateBucketIfNotExists(boltTranslationBucket)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// open runs fn with the database open, read-only databases share the file lock
+func (s *boltStore) open(readOnly bool, fn func(db *bolt.DB) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{ReadOnly: readOnly, Timeout: boltOpenTimeout})
+	if err != nil {
+		return err
+	}
+	err = fn(db)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *boltStore) View(fn func(tx stateTx) error) error {
+	return s.open(true, func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			return fn(boltTx{tx})
+		})
+	})
+}
+
+func (s *boltStore) Update(fn func(tx stateTx) error) error {
+	return s.open(false, func(db *bolt.DB) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			return fn(boltTx{tx})
+		})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return nil
+}
+
+// Services lists services with any state, history or translations
+func (t boltTx) Services() ([]string, error) {
+	found := map[string]bool{}
+	for _, name := range [][]byte{boltStateBucket, boltHistoryBucket, boltTranslationBucket} {
+		err := t.tx.Bucket(name).ForEach(func(k, v []byte) error {
+			found[string(k)] = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	var services []string
+	for service := range found {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+func (t boltTx) config(service string) (Config, error) {
+	var config Config
+	value := t.tx.Bucket(boltStateBucket).Get([]byte(service))
+	if value == nil {
+		return config, nil
+	}
+	err := json.Unmarshal(value, &config)
+	return config, err
+}
+
+func (t boltTx) LastSentDate(service string) (string, error) {
+	config, err := t.config(service)
+	return config.LastSentDate, err
+}
+
+func (t boltTx) SetLastSentDate(service string, date string) error {
+	config, err := t.config(service)
+	if err != nil {
+		return err
+	}
+	config.LastSentDate = date
+	value, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return t.tx.Bucket(boltStateBucket).Put([]byte(service), value)
+}
+
+func (t boltTx) AddDelivery(delivery Delivery) error {
+	bucket, err := t.tx.Bucket(boltHistoryBucket).CreateBucketIfNotExists([]byte(delivery.Service))
+	if err != nil {
+		return err
+	}
+	sequence, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	delivery.ID = int64(sequence)
+	return putDelivery(bucket, delivery)
+}
+
+func putDelivery(bucket *bolt.Bucket, delivery Delivery) error {
+	value, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(deliveryKey(delivery.ID), value)
+}
+
+func deliveryKey(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+func (t boltTx) UpdateDelivery(delivery Delivery) error {
+	bucket := t.tx.Bucket(boltHistoryBucket).Bucket([]byte(delivery.Service))
+	if bucket == nil || bucket.Get(deliveryKey(delivery.ID)) == nil {
+		return errDeliveryNotFound
+	}
+	return putDelivery(bucket, delivery)
+}
+
+func (t boltTx) DeleteDelivery(service string, id int64) error {
+	bucket := t.tx.Bucket(boltHistoryBucket).Bucket([]byte(service))
+	if bucket == nil || bucket.Get(deliveryKey(id)) == nil {
+		return errDeliveryNotFound
+	}
+	return bucket.Delete(deliveryKey(id))
+}
+
+func (t boltTx) Deliveries(service string) ([]Delivery, error) {
+	var deliveries []Delivery
+	bucket := t.tx.Bucket(boltHistoryBucket).Bucket([]byte(service))
+	if bucket == nil {
+		return deliveries, nil
+	}
+	err := bucket.ForEach(func(k, v []byte) error {
+		var delivery Delivery
+		err := json.Unmarshal(v, &delivery)
+		if err != nil {
+			return err
+		}
+		deliveries = append(deliveries, delivery)
+		return nil
+	})
+	return deliveries, err
+}
+
+func (t boltTx) Translation(service string, date string, language string) (Translation, error) {
+	var translation Translation
+	bucket := t.tx.Bucket(boltTranslationBucket).Bucket([]byte(service))
+	if bucket == nil {
+		return translation, nil
+	}
+	value := bucket.Get([]byte(translationKey(date, language)))
+	if value == nil {
+		return translation, nil
+	}
+	err := json.Unmarshal(value, &translation)
+	return translation, err
+}
+
+func (t boltTx) SetTranslation(service string, date string, language string, translation Translation) error {
+	bucket, err := t.tx.Bucket(boltTranslationBucket).CreateBucketIfNotExists([]byte(service))
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(translation)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(translationKey(date, language)), value)
+}
+
+func (t boltTx) Translations(service string) (map[string]Translation, error) {
+	translations := map[string]Translation{}
+	bucket := t.tx.Bucket(boltTranslationBucket).Bucket([]byte(service))
+	if bucket == nil {
+		return translations, nil
+	}
+	err := bucket.ForEach(func(k, v []byte) error {
+		var translation Translation
+		err := json.Unmarshal(v, &translation)
+		translations[string(k)] = translation
+		return err
+	})
+	return translations, err
+}
@@ -2,68 +2,351 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
-const configFile = "status.json"
+const (
+	configFile       = "status.json"
+	stateEnvVariable = "APOD_BOT_STATE"
+	stateAppName     = "apod-bot"
+)
 
 var fullConfigFilePath = ""
 
+var (
+	errCorruptedConfig  = errors.New("Config is corrupted")
+	errDeliveryNotFound = errors.New("Delivery not found")
+)
+
+const (
+	sourceAPI  = "api"
+	sourceHTML = "html"
+)
+
 type Config struct {
 	LastSentDate string
+	History      []Delivery `json:",omitempty"`
+	// Translations are keyed by "date/language"
+	Translations map[string]Translation `json:",omitempty"`
+}
+
+// Delivery is a successfully posted APOD
+type Delivery struct {
+	ID         int64
+	Date       string
+	Service    string
+	Chat       int64
+	MessageIDs []string
+	// MessageKinds describes each of MessageIDs, e.g. photo or document
+	MessageKinds []string
+	Source       string
+	StartedAt    time.Time
+	SentAt       time.Time
+	// Picture is what was posted, updates are compared against it
+	Picture   picture
+	CheckedAt time.Time
+	// Partial delivery failed after some messages were sent
+	Partial bool `json:",omitempty"`
 }
 
 func configFilePath() string {
 	if len(fullConfigFilePath) > 0 {
 		return fullConfigFilePath
 	}
-	ex, err := os.Executable()
+	directoryPath, err := stateDirectory("")
 	if err != nil {
 		panic(err)
 	}
-	directoryPath := filepath.Dir(ex)
-	return path.Join(directoryPath, configFile)
+	return filepath.Join(directoryPath, configFile)
+}
+
+// stateDirectory picks state location: explicit path, APOD_BOT_STATE,
+// systemd StateDirectory=, XDG_STATE_HOME or ~/.local/state
+func stateDirectory(explicit string) (string, error) {
+	if len(explicit) > 0 {
+		return explicit, nil
+	}
+	if dir := os.Getenv(stateEnvVariable); len(dir) > 0 {
+		return dir, nil
+	}
+	// systemd passes colon separated list if several directories are configured
+	if dirs := os.Getenv("STATE_DIRECTORY"); len(dirs) > 0 {
+		return strings.Split(dirs, ":")[0], nil
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); len(dir) > 0 {
+		return filepath.Join(dir, stateAppName), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state", stateAppName), nil
+}
+
+// legacyStateDirectory is where state lived before it became configurable
+func legacyStateDirectory() (string, error) {
+	ex, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Dir(ex), nil
 }
 
-func readConfig() map[string]Config {
+// setupStateDirectory creates state directory and moves state files
+// from the legacy location there once
+func setupStateDirectory(directoryPath string, legacyDirectoryPath string) error {
+	err := os.MkdirAll(directoryPath, 0755)
+	if err != nil {
+		return err
+	}
+	fullConfigFilePath = filepath.Join(directoryPath, configFile)
+
+	for _, name := range []string{configFile, boltFile} {
+		legacyPath := filepath.Join(legacyDirectoryPath, name)
+		newPath := filepath.Join(directoryPath, name)
+		if legacyPath == newPath {
+			continue
+		}
+		if _, err := os.Stat(newPath); err == nil {
+			continue
+		}
+		if _, err := os.Stat(legacyPath); err != nil {
+			continue
+		}
+		err = moveFile(legacyPath, newPath)
+		if err != nil {
+			return fmt.Errorf("Can't migrate %s: %w", legacyPath, err)
+		}
+		fmt.Println("State migrated from", legacyPath, "to", newPath)
+	}
+	return nil
+}
+
+// dryRunStateDirectory is where state would be read from after setupStateDirectory,
+// legacy state is read in place since dry run doesn't move files
+func dryRunStateDirectory(directoryPath string, legacyDirectoryPath string) string {
+	for _, name := range []string{configFile, boltFile} {
+		if _, err := os.Stat(filepath.Join(directoryPath, name)); err == nil {
+			return directoryPath
+		}
+	}
+	for _, name := range []string{configFile, boltFile} {
+		if _, err := os.Stat(filepath.Join(legacyDirectoryPath, name)); err == nil {
+			fmt.Println("DRY RUN: reading state from legacy location", legacyDirectoryPath)
+			return legacyDirectoryPath
+		}
+	}
+	return directoryPath
+}
+
+// moveFile falls back to copying when rename isn't possible (different file systems)
+func moveFile(from string, to string) error {
+	if os.Rename(from, to) == nil {
+		return nil
+	}
+	body, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(to+".tmp", body, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(to+".tmp", to)
+	if err != nil {
+		return err
+	}
+	// Read-only legacy location is fine, new copy is already in place
+	if err := os.Remove(from); err != nil {
+		fmt.Println("Can't remove legacy state:", err)
+	}
+	return nil
+}
+
+// readConfig returns an empty config if it doesn't exist yet and
+// errCorruptedConfig if it can't be read, so callers never mistake
+// a broken file for "nothing was sent".
+func readConfig() (map[string]Config, error) {
 	body, err := ioutil.ReadFile(configFilePath())
+	if os.IsNotExist(err) {
+		return map[string]Config{}, nil
+	}
 	if err != nil {
-		return map[string]Config{}
+		return nil, err
 	}
 
 	var config map[string]Config
 	err = json.Unmarshal(body, &config)
-	if err != nil {
-		fmt.Println("Can't unmarshal config:", err)
+	if err != nil || config == nil {
+		return nil, fmt.Errorf("%w: %s (%v)", errCorruptedConfig, configFilePath(), err)
 	}
-	return config
+	return config, nil
 }
 
-func saveConfig(config map[string]Config) {
+// saveConfig writes a temporary file and renames it over the config,
+// so a crash never leaves a truncated file behind.
+func saveConfig(config map[string]Config) error {
 	body, err := json.Marshal(config)
 	if err != nil {
-		fmt.Println("Can't marshal config:", err)
-		return
+		return err
+	}
+
+	filePath := configFilePath()
+	f, err := ioutil.TempFile(filepath.Dir(filePath), "."+filepath.Base(filePath)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(body)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(f.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filePath)
+}
+
+// configMutex serializes updates within the process, file lock may be a no-op
+var configMutex sync.Mutex
+
+// updateConfig runs read-modify-write under the config lock,
+// nothing is written if update fails
+func updateConfig(update func(config map[string]Config) error) error {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	unlock, err := lockFile(configFilePath() + ".lock")
+	if err != nil {
+		return err
 	}
-	err = ioutil.WriteFile(configFilePath(), body, 0644)
+	defer unlock()
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	err = update(config)
+	if err != nil {
+		return err
+	}
+	return saveConfig(config)
+}
+
+// jsonStore keeps state in a single JSON file, fine for tiny deployments
+type jsonStore struct{}
+
+// jsonTx works on the config loaded into memory
+type jsonTx struct {
+	config map[string]Config
+}
+
+func (jsonStore) View(fn func(tx stateTx) error) error {
+	config, err := readConfig()
 	if err != nil {
-		fmt.Println("Can't write config:", err)
+		return err
 	}
+	return fn(jsonTx{config})
+}
+
+func (jsonStore) Update(fn func(tx stateTx) error) error {
+	return updateConfig(func(config map[string]Config) error {
+		return fn(jsonTx{config})
+	})
 }
 
-func readLastSentDate(service string) string {
-	config := readConfig()
-	return config[service].LastSentDate
+func (jsonStore) Close() error {
+	return nil
+}
+
+func (t jsonTx) Services() ([]string, error) {
+	var services []string
+	for service := range t.config {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+func (t jsonTx) LastSentDate(service string) (string, error) {
+	return t.config[service].LastSentDate, nil
+}
+
+func (t jsonTx) SetLastSentDate(service string, date string) error {
+	var serviceConfig = t.config[service]
+	serviceConfig.LastSentDate = date
+	t.config[service] = serviceConfig
+	return nil
+}
+
+func (t jsonTx) AddDelivery(delivery Delivery) error {
+	var serviceConfig = t.config[delivery.Service]
+	delivery.ID = 1
+	if count := len(serviceConfig.History); count > 0 {
+		delivery.ID = serviceConfig.History[count-1].ID + 1
+	}
+	serviceConfig.History = append(serviceConfig.History, delivery)
+	t.config[delivery.Service] = serviceConfig
+	return nil
+}
+
+func (t jsonTx) Deliveries(service string) ([]Delivery, error) {
+	return t.config[service].History, nil
+}
+
+func (t jsonTx) UpdateDelivery(delivery Delivery) error {
+	history := t.config[delivery.Service].History
+	for i := range history {
+		if history[i].ID == delivery.ID {
+			history[i] = delivery
+			return nil
+		}
+	}
+	return errDeliveryNotFound
+}
+
+func (t jsonTx) DeleteDelivery(service string, id int64) error {
+	serviceConfig := t.config[service]
+	for i, delivery := range serviceConfig.History {
+		if delivery.ID == id {
+			serviceConfig.History = append(serviceConfig.History[:i], serviceConfig.History[i+1:]...)
+			t.config[service] = serviceConfig
+			return nil
+		}
+	}
+	return errDeliveryNotFound
+}
+
+func (t jsonTx) Translation(service string, date string, language string) (Translation, error) {
+	return t.config[service].Translations[translationKey(date, language)], nil
+}
+
+func (t jsonTx) SetTranslation(service string, date string, language string, translation Translation) error {
+	serviceConfig := t.config[service]
+	if serviceConfig.Translations == nil {
+		serviceConfig.Translations = map[string]Translation{}
+	}
+	serviceConfig.Translations[translationKey(date, language)] = translation
+	t.config[service] = serviceConfig
+	return nil
 }
 
-func saveCurrentDate(service string, dateString string) {
-	config := readConfig()
-	var serviceConfig = config[service]
-	serviceConfig.LastSentDate = dateString
-	config[service] = serviceConfig
-	saveConfig(config)
+func (t jsonTx) Translations(service string) (map[string]Translation, error) {
+	return t.config[service].Translations, nil
 }
@@ -1,25 +1,351 @@
 package main
 
 import (
+	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
 func TestEmptyConfig(t *testing.T) {
 	fullConfigFilePath = "test-config.json"
 	defer os.Remove(fullConfigFilePath)
+	defer os.Remove(fullConfigFilePath + ".lock")
 
-	if readLastSentDate("test") != "" {
+	lastDate, err := readLastSentDate(jsonStore{}, "test")
+	if err != nil {
+		t.Error(err)
+	}
+	if lastDate != "" {
 		t.Error("Last date should be empty")
 	}
 
-	saveCurrentDate("test", "2020-04-04")
-	config := readConfig()
+	err = saveCurrentDate(jsonStore{}, "test", "2020-04-04")
+	if err != nil {
+		t.Error(err)
+	}
+	config, err := readConfig()
+	if err != nil {
+		t.Error(err)
+	}
 	if len(config) == 0 {
 		t.Error("Saved config shouldn't be empty")
 	}
 
-	if readLastSentDate("test") == "" {
+	lastDate, err = readLastSentDate(jsonStore{}, "test")
+	if err != nil {
+		t.Error(err)
+	}
+	if lastDate == "" {
 		t.Error("Last date should not be empty")
 	}
 }
+
+func TestCorruptedConfig(t *testing.T) {
+	fullConfigFilePath = "test-config.json"
+	defer os.Remove(fullConfigFilePath)
+	defer os.Remove(fullConfigFilePath + ".lock")
+
+	for _, body := range []string{"", "{\"tg\":{\"LastSent", "null"} {
+		err := ioutil.WriteFile(fullConfigFilePath, []byte(body), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = readLastSentDate(jsonStore{}, "tg")
+		if !errors.Is(err, errCorruptedConfig) {
+			t.Errorf("%q: expected corrupted config error, got %v", body, err)
+		}
+		err = saveCurrentDate(jsonStore{}, "tg", "2020-04-04")
+		if !errors.Is(err, errCorruptedConfig) {
+			t.Errorf("%q: corrupted config shouldn't be overwritten, got %v", body, err)
+		}
+	}
+}
+
+func TestConcurrentSave(t *testing.T) {
+	fullConfigFilePath = "test-config.json"
+	defer os.Remove(fullConfigFilePath)
+	defer os.Remove(fullConfigFilePath + ".lock")
+
+	services := []string{"tg", "tt", "a", "b", "c", "d", "e", "f"}
+	var wg sync.WaitGroup
+	for _, service := range services {
+		wg.Add(1)
+		go func(service string) {
+			defer wg.Done()
+			err := saveCurrentDate(jsonStore{}, service, "2020-04-04")
+			if err != nil {
+				t.Error(err)
+			}
+		}(service)
+	}
+	wg.Wait()
+
+	config, err := readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config) != len(services) {
+		t.Errorf("Expected %d services, got %v", len(services), config)
+	}
+}
+
+func TestSaveDelivery(t *testing.T) {
+	fullConfigFilePath = "test-config.json"
+	defer os.Remove(fullConfigFilePath)
+	defer os.Remove(fullConfigFilePath + ".lock")
+
+	delivery := Delivery{Date: "2020-04-04", Service: "tg", Chat: 42, MessageIDs: []string{"1", "2"}, Source: sourceAPI}
+	err := saveDelivery(jsonStore{}, delivery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery.Date = "2020-04-05"
+	err = saveDelivery(jsonStore{}, delivery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastDate, err := readLastSentDate(jsonStore{}, "tg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastDate != "2020-04-05" {
+		t.Error("Unexpected last date", lastDate)
+	}
+	config, err := readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := config["tg"].History
+	if len(history) != 2 || history[0].Date != "2020-04-04" || len(history[1].MessageIDs) != 2 {
+		t.Errorf("Unexpected history %v", history)
+	}
+}
+
+func TestBoltStoreMigration(t *testing.T) {
+	fullConfigFilePath = "test-config.json"
+	defer os.Remove(fullConfigFilePath)
+	defer os.Remove(fullConfigFilePath + ".lock")
+	defer os.Remove(fullConfigFilePath + ".migrated")
+	const boltPath = "test-status.db"
+	defer os.Remove(boltPath)
+
+	delivery := Delivery{Date: "2020-04-04", Service: "tg", Chat: 42, MessageIDs: []string{"1", "2"}, Source: sourceHTML}
+	err := saveDelivery(jsonStore{}, delivery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = saveCurrentDate(jsonStore{}, "tt", "2020-04-03")
+	if err != nil {
+		t.Fatal(err)
+	}
+	translation := Translation{Title: "Заголовок", Explanation: "Пояснение", Checksum: "sum"}
+	err = jsonStore{}.Update(func(tx stateTx) error {
+		return tx.SetTranslation("tt", "2020-04-03", "ru", translation)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := openBoltStoreWithMigration(boltPath, fullConfigFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fullConfigFilePath); !os.IsNotExist(err) {
+		t.Error("JSON state should be renamed after migration")
+	}
+
+	var cached Translation
+	err = store.View(func(tx stateTx) error {
+		cached, err = tx.Translation("tt", "2020-04-03", "ru")
+		return err
+	})
+	if err != nil || cached != translation {
+		t.Errorf("Translation should be migrated, got %v (%v)", cached, err)
+	}
+
+	for service, expected := range map[string]string{"tg": "2020-04-04", "tt": "2020-04-03"} {
+		lastDate, err := readLastSentDate(store, service)
+		if err != nil {
+			t.Error(err)
+		}
+		if lastDate != expected {
+			t.Errorf("%s: expected %s, got %s", service, expected, lastDate)
+		}
+	}
+
+	delivery.Date = "2020-04-05"
+	err = saveDelivery(store, delivery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deliveries []Delivery
+	err = store.View(func(tx stateTx) error {
+		deliveries, err = tx.Deliveries("tg")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 || deliveries[0].Source != sourceHTML || deliveries[1].Date != "2020-04-05" {
+		t.Errorf("Unexpected history %v", deliveries)
+	}
+
+	// Failed transaction shouldn't change anything
+	err = store.Update(func(tx stateTx) error {
+		tx.SetLastSentDate("tg", "2020-04-06")
+		return errCorruptedConfig
+	})
+	if err != errCorruptedConfig {
+		t.Error("Unexpected update error", err)
+	}
+	lastDate, _ := readLastSentDate(store, "tg")
+	if lastDate != "2020-04-05" {
+		t.Error("Failed transaction changed last date to", lastDate)
+	}
+	store.Close()
+
+	// Restored JSON state doesn't overwrite newer database
+	err = saveCurrentDate(jsonStore{}, "tg", "2020-04-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err = openBoltStoreWithMigration(boltPath, fullConfigFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	lastDate, _ = readLastSentDate(store, "tg")
+	if lastDate != "2020-04-05" {
+		t.Error("JSON state overwrote database, last date is", lastDate)
+	}
+	if _, err := os.Stat(fullConfigFilePath); err != nil {
+		t.Error("Ignored JSON state should be kept", err)
+	}
+
+	// Another run doesn't wait for the open store
+	other, err := openBoltStore(boltPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = saveCurrentDate(other, "tt", "2020-04-06")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastDate, _ = readLastSentDate(store, "tt")
+	if lastDate != "2020-04-06" {
+		t.Error("Change of another run isn't visible, last date is", lastDate)
+	}
+}
+
+func TestStateDirectory(t *testing.T) {
+	t.Setenv(stateEnvVariable, "")
+	t.Setenv("STATE_DIRECTORY", "")
+	t.Setenv("XDG_STATE_HOME", "/xdg")
+	t.Setenv("HOME", "/home/apod")
+
+	tests := []struct {
+		explicit string
+		env      map[string]string
+		expected string
+	}{
+		{"", nil, "/xdg/apod-bot"},
+		{"", map[string]string{"XDG_STATE_HOME": ""}, "/home/apod/.local/state/apod-bot"},
+		{"", map[string]string{"STATE_DIRECTORY": "/var/lib/apod:/var/lib/other"}, "/var/lib/apod"},
+		{"", map[string]string{"STATE_DIRECTORY": "/var/lib/apod", stateEnvVariable: "/env"}, "/env"},
+		{"/flag", map[string]string{stateEnvVariable: "/env"}, "/flag"},
+	}
+	for _, test := range tests {
+		for key, value := range test.env {
+			t.Setenv(key, value)
+		}
+		dir, err := stateDirectory(test.explicit)
+		if err != nil {
+			t.Error(err)
+		}
+		if dir != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, dir)
+		}
+	}
+}
+
+func TestStateMigration(t *testing.T) {
+	defer func() { fullConfigFilePath = "" }()
+	legacyDir := t.TempDir()
+	stateDir := filepath.Join(t.TempDir(), "state")
+
+	legacyBody := []byte(`{"tg":{"LastSentDate":"2020-04-04"}}`)
+	err := ioutil.WriteFile(filepath.Join(legacyDir, configFile), legacyBody, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = setupStateDirectory(stateDir, legacyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fullConfigFilePath != filepath.Join(stateDir, configFile) {
+		t.Error("Unexpected config path", fullConfigFilePath)
+	}
+	lastDate, err := readLastSentDate(jsonStore{}, "tg")
+	if err != nil || lastDate != "2020-04-04" {
+		t.Errorf("Legacy state isn't migrated: %s (%v)", lastDate, err)
+	}
+	if _, err := os.Stat(filepath.Join(legacyDir, configFile)); !os.IsNotExist(err) {
+		t.Error("Legacy state should be moved")
+	}
+
+	// Existing state is never overwritten by legacy one
+	err = ioutil.WriteFile(filepath.Join(legacyDir, configFile), []byte(`{}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setupStateDirectory(stateDir, legacyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastDate, _ = readLastSentDate(jsonStore{}, "tg")
+	if lastDate != "2020-04-04" {
+		t.Error("State is overwritten by legacy state")
+	}
+}
+
+func TestDryRunStateDirectory(t *testing.T) {
+	legacyDir := t.TempDir()
+	stateDir := filepath.Join(t.TempDir(), "state")
+
+	if dir := dryRunStateDirectory(stateDir, legacyDir); dir != stateDir {
+		t.Error("Expected new state directory without any state, got", dir)
+	}
+
+	legacyPath := filepath.Join(legacyDir, boltFile)
+	err := ioutil.WriteFile(legacyPath, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir := dryRunStateDirectory(stateDir, legacyDir); dir != legacyDir {
+		t.Error("Expected legacy state directory, got", dir)
+	}
+	if _, err := os.Stat(legacyPath); err != nil {
+		t.Error("Legacy state shouldn't be moved:", err)
+	}
+	if _, err := os.Stat(stateDir); !os.IsNotExist(err) {
+		t.Error("State directory shouldn't be created:", err)
+	}
+
+	// Migrated state wins
+	err = os.MkdirAll(stateDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(stateDir, configFile), []byte(`{}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir := dryRunStateDirectory(stateDir, legacyDir); dir != stateDir {
+		t.Error("Expected new state directory, got", dir)
+	}
+}
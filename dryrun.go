@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const dryRunUploadHost = "dry-run.invalid"
+
+// dryRunService tells which messenger API the request goes to, those are faked in dry-run mode,
+// everything else (NASA, thumbnails) is real
+func dryRunService(req *http.Request) string {
+	switch req.URL.Host {
+	case urlHost(tgBaseURL):
+		return "tg"
+	case urlHost(ttBaseURL), dryRunUploadHost:
+		return "tt"
+	}
+	return ""
+}
+
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+var errDryRun = errors.New("dry run")
+
+// dryRunTransport prints requests to messenger APIs instead of sending them
+// and answers with a minimal successful response
+type dryRunTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(dryRunService(req)) == 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	url := req.URL.String()
+	if len(t.token) > 0 {
+		url = strings.ReplaceAll(url, t.token, "<token>")
+	}
+	fmt.Println("DRY RUN:", req.Method, url)
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		printDryRunBody(req.Header.Get("Content-Type"), body)
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(dryRunResponse(req))),
+		Request:    req,
+	}, nil
+}
+
+func dryRunResponse(req *http.Request) string {
+	switch {
+	case dryRunService(req) == "tg":
+		return `{"ok":true,"result":{"message_id":0}}`
+	case req.URL.Hostname() == dryRunUploadHost:
+		return `{"token":"dry-run","photos":{"dry-run":{"token":"dry-run"}}}`
+	case req.URL.Path == "/uploads":
+		return `{"url":"https://` + dryRunUploadHost + `/upload","token":"dry-run"}`
+	case req.Method == http.MethodPost:
+		return `{"message":{"body":{"mid":"dry-run"}}}`
+	}
+	return `{"success":true}`
+}
+
+func printDryRunBody(contentType string, body []byte) {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if mediaType != "multipart/form-data" {
+		var indented bytes.Buffer
+		if json.Indent(&indented, body, "  ", "  ") == nil {
+			fmt.Println("  " + indented.String())
+		} else if len(body) > 0 {
+			fmt.Printf("  %d bytes of %s\n", len(body), contentType)
+		}
+		return
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			fmt.Println("  Broken multipart body:", err)
+			return
+		}
+		value, _ := ioutil.ReadAll(part)
+		if len(part.FileName()) > 0 {
+			fmt.Printf("  %s: file %s, %d bytes (%s)\n", part.FormName(), part.FileName(), len(value), http.DetectContentType(value))
+		} else {
+			fmt.Printf("  %s: %s\n", part.FormName(), string(value))
+		}
+	}
+}
+
+// dryRunStore rolls back every change
+type dryRunStore struct {
+	stateStore
+}
+
+func (s dryRunStore) Update(fn func(tx stateTx) error) error {
+	err := s.stateStore.Update(func(tx stateTx) error {
+		err := fn(tx)
+		if err != nil {
+			return err
+		}
+		return errDryRun
+	})
+	if err == errDryRun {
+		fmt.Println("DRY RUN: state isn't changed")
+		return nil
+	}
+	return err
+}
+
+// openDryRunStore loads state into memory, files aren't created, locked or changed
+func openDryRunStore(storage string) (stateStore, error) {
+	switch storage {
+	case storageJSON:
+		config, err := readConfig()
+		if err != nil {
+			return nil, err
+		}
+		return &memoryStore{config}, nil
+	case storageBolt:
+		_, err := os.Stat(boltFilePath())
+		if os.IsNotExist(err) {
+			// JSON state would be migrated on real run
+			return openDryRunStore(storageJSON)
+		}
+		// Views open the database read-only
+		store := &memoryStore{map[string]Config{}}
+		return store, migrateStore(&boltStore{path: boltFilePath()}, store)
+	}
+	return nil, fmt.Errorf("Unknown storage: %s", storage)
+}
+
+// memoryStore keeps state in memory, failed updates are discarded
+type memoryStore struct {
+	config map[string]Config
+}
+
+func (s *memoryStore) View(fn func(tx stateTx) error) error {
+	return fn(jsonTx{s.config})
+}
+
+func (s *memoryStore) Update(fn func(tx stateTx) error) error {
+	body, err := json.Marshal(s.config)
+	if err != nil {
+		return err
+	}
+	var config map[string]Config
+	err = json.Unmarshal(body, &config)
+	if err != nil {
+		return err
+	}
+	err = fn(jsonTx{config})
+	if err != nil {
+		return err
+	}
+	s.config = config
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
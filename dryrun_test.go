@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type failingTransport struct {
+	requests int
+}
+
+func (t *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests++
+	return nil, errors.New("network is disabled")
+}
+
+func TestDryRunTransport(t *testing.T) {
+	next := &failingTransport{}
+	useTransport(t, dryRunTransport{"secret", next})
+
+	item := picture{
+		Title:       "Mars Rotates",
+		Explanation: "As Mars approaches, its surface features rotate into view.",
+		MediaType:   mediaTypeVideo,
+		URL:         "https://apod.nasa.gov/apod/image/0308/marsrotates.swf",
+	}
+	messages, err := tgSendVideo(item, "secret", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Kind != messageKindText {
+		t.Errorf("Unexpected messages %v", messages)
+	}
+
+	messages, err = ttSendVideo(item, "secret", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].ID != "dry-run" {
+		t.Errorf("Unexpected messages %v", messages)
+	}
+
+	if next.requests != 0 {
+		t.Error("Messenger API requests shouldn't leave dry run transport")
+	}
+}
+
+func TestDryRunStore(t *testing.T) {
+	fullConfigFilePath = "test-config.json"
+	defer os.Remove(fullConfigFilePath)
+	defer os.Remove(fullConfigFilePath + ".lock")
+
+	store := dryRunStore{jsonStore{}}
+	err := saveDelivery(store, Delivery{Date: "2020-04-04", Service: "tg", Chat: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastDate, err := readLastSentDate(store, "tg")
+	if err != nil || lastDate != "" {
+		t.Errorf("Dry run shouldn't change state, got %s (%v)", lastDate, err)
+	}
+	if _, err := os.Stat(fullConfigFilePath); !os.IsNotExist(err) {
+		t.Error("Dry run shouldn't write state")
+	}
+}
+
+func TestDryRunStoreFiles(t *testing.T) {
+	defer func(path string) { fullConfigFilePath = path }(fullConfigFilePath)
+	for _, storage := range []string{storageJSON, storageBolt} {
+		dir := filepath.Join(t.TempDir(), "missing")
+		fullConfigFilePath = filepath.Join(dir, configFile)
+
+		store, err := openDryRunStore(storage)
+		if err != nil {
+			t.Fatal(storage, err)
+		}
+		err = saveDelivery(dryRunStore{store}, Delivery{Date: "2020-04-04", Service: "tg", Chat: 42})
+		if err != nil {
+			t.Error(storage, err)
+		}
+		store.Close()
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%s: dry run shouldn't create state files", storage)
+		}
+	}
+
+	// Existing database is read without changes
+	dir := t.TempDir()
+	fullConfigFilePath = filepath.Join(dir, configFile)
+	db, err := openBoltStore(boltFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = saveCurrentDate(db, "tg", "2020-04-03")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(boltFilePath())
+	store, err := openDryRunStore(storageBolt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = saveCurrentDate(store, "tg", "2020-04-04")
+	lastDate, _ := readLastSentDate(store, "tg")
+	if err != nil || lastDate != "2020-04-04" {
+		t.Errorf("Expected state in memory, got %s (%v)", lastDate, err)
+	}
+	if after, _ := os.Stat(boltFilePath()); !after.ModTime().Equal(info.ModTime()) || after.Size() != info.Size() {
+		t.Error("Dry run changed the database")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+		t.Errorf("Unexpected files %v", files)
+	}
+}
@@ -2,11 +2,15 @@ module github.com/vox-humana/apod-bot
 
 go 1.20
 
-require github.com/antchfx/htmlquery v1.3.0
+require (
+	github.com/antchfx/htmlquery v1.3.0
+	go.etcd.io/bbolt v1.3.7
+	golang.org/x/net v0.7.0
+)
 
 require (
 	github.com/antchfx/xpath v1.2.4 // indirect
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
-	golang.org/x/net v0.7.0 // indirect
+	golang.org/x/sys v0.5.0 // indirect
 	golang.org/x/text v0.7.0 // indirect
 )
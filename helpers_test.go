@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useTransport sends requests of the shared client to next without retries
+func useTransport(t *testing.T, next http.RoundTripper) {
+	defaultTransport := *httpTransport
+	httpTransport.Next = next
+	httpTransport.Retries = 0
+	t.Cleanup(func() { *httpTransport = defaultTransport })
+}
+
+type scriptedResponse struct {
+	status int
+	body   string
+}
+
+type recordedCall struct {
+	Path          string
+	ContentType   string
+	ContentLength int64
+	Body          string
+}
+
+// apiStandIn answers requests with responses in order, repeating the last one
+type apiStandIn struct {
+	*httptest.Server
+	mutex sync.Mutex
+	calls []recordedCall
+}
+
+func newAPIStandIn(t *testing.T, responses ...scriptedResponse) *apiStandIn {
+	standIn := &apiStandIn{}
+	standIn.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		standIn.mutex.Lock()
+		defer standIn.mutex.Unlock()
+		standIn.calls = append(standIn.calls, recordedCall{r.URL.RequestURI(), r.Header.Get("Content-Type"), r.ContentLength, string(body)})
+		response := responses[len(responses)-1]
+		if len(standIn.calls) <= len(responses) {
+			response = responses[len(standIn.calls)-1]
+		}
+		w.WriteHeader(response.status)
+		w.Write([]byte(response.body))
+	}))
+	t.Cleanup(standIn.Close)
+	useTransport(t, http.DefaultTransport)
+
+	defaultUnit := retryAfterUnit
+	retryAfterUnit = time.Millisecond
+	t.Cleanup(func() { retryAfterUnit = defaultUnit })
+	return standIn
+}
+
+type recordedRequest struct {
+	Method  string
+	URL     string
+	Body    map[string]interface{}
+	RawBody string
+}
+
+// recordingTransport answers every request with responseBody, or with media for NASA files,
+// and keeps requests
+type recordingTransport struct {
+	mutex        sync.Mutex
+	requests     []recordedRequest
+	responseBody string
+	media        []byte
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	record := recordedRequest{Method: req.Method, URL: req.URL.String()}
+	if req.Body != nil {
+		body, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(body, &record.Body)
+		record.RawBody = string(body)
+	}
+	t.mutex.Lock()
+	t.requests = append(t.requests, record)
+	t.mutex.Unlock()
+	body := []byte(t.responseBody)
+	if t.media != nil && req.URL.Host == "apod.nasa.gov" {
+		body = t.media
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Status:        "200 OK",
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+func recordRequests(t *testing.T, responseBody string) *recordingTransport {
+	transport := &recordingTransport{responseBody: responseBody}
+	useTransport(t, transport)
+	return transport
+}
+
+func postedPicture() picture {
+	return picture{
+		Copyright:    "Francesco Antonucci",
+		Date:         "2020-01-28",
+		Explanation:  "What's all of the commotion in the Tadpole Nebula? Star formation.",
+		Title:        "Star Formation in the Tadpole Nebula",
+		MediaType:    mediaTypeImage,
+		FullImageURL: "https://apod.nasa.gov/apod/image/2001/ic410_WISEantonucci_1824.jpg",
+		URL:          "https://apod.nasa.gov/apod/image/2001/ic410_WISEantonucci_960.jpg",
+		Link:         "https://apod.nasa.gov/apod/ap200128.html",
+	}
+}
+
+func noiseImage(width, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	random := rand.New(rand.NewSource(1))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{uint8(random.Intn(256)), uint8(x), uint8(y), 255})
+		}
+	}
+	var b bytes.Buffer
+	png.Encode(&b, img)
+	return b.Bytes()
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/antchfx/htmlquery"
+	"golang.org/x/net/html"
+)
+
+// APOD pages changed their markup many times since 1995, so instead of fixed
+// XPaths the parser looks for the first media element, the first bold caption
+// after it, the "Explanation:" block and anything that looks like a date.
+
+var errFieldNotFound = errors.New("not found")
+
+// htmlFieldError reports which APOD page field couldn't be extracted.
+type htmlFieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *htmlFieldError) Error() string {
+	return fmt.Sprintf("Can't parse APOD page %s: %v", e.Field, e.Err)
+}
+
+func (e *htmlFieldError) Unwrap() error {
+	return e.Err
+}
+
+func fieldNotFound(field string) error {
+	return &htmlFieldError{field, errFieldNotFound}
+}
+
+var (
+	htmlDateLong  = regexp.MustCompile(`(\d{4})\s+(January|February|March|April|May|June|July|August|September|October|November|December)\s+(\d{1,2})`)
+	htmlDateShort = regexp.MustCompile(`(January|February|March|April|May|June|July|August|September|October|November|December)\s+(\d{1,2}),\s*(\d{4})`)
+)
+
+type htmlMedia struct {
+	node         *html.Node
+	mediaType    string
+	url          string
+	fullImageURL string
+}
+
+func makePictureFromHTML(reader io.Reader, p *picture) error {
+	doc, err := htmlquery.Parse(reader)
+	if err != nil {
+		return err
+	}
+	nodes := elements(doc)
+
+	media, err := findMedia(nodes)
+	if err != nil {
+		return err
+	}
+
+	explanationNode := findExplanation(nodes)
+	if explanationNode == nil {
+		return fieldNotFound("explanation")
+	}
+
+	title := findTitle(nodes, media.node, explanationNode)
+	if len(title) == 0 {
+		title = titleFromHead(doc)
+	}
+	if len(title) == 0 {
+		return fieldNotFound("title")
+	}
+
+	pictureDate, err := findDate(doc)
+	if err != nil {
+		return err
+	}
+
+	p.Title = title
+	p.Explanation = explanationText(explanationNode)
+	p.URL = media.url
+	p.FullImageURL = media.fullImageURL
+	p.MediaType = media.mediaType
+	p.Date = pictureDate
+	p.trim()
+	return nil
+}
+
+// elements returns all element nodes of the document in document order.
+func elements(doc *html.Node) []*html.Node {
+	var nodes []*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			nodes = append(nodes, n)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return nodes
+}
+
+func findMedia(nodes []*html.Node) (htmlMedia, error) {
+	for _, n := range nodes {
+		switch n.Data {
+		case "img":
+			src := htmlquery.SelectAttr(n, "src")
+			if len(src) == 0 {
+				continue
+			}
+			media := htmlMedia{node: n, mediaType: mediaTypeImage, url: resolveSiteURL(src)}
+			if link := parentLink(n); link != nil {
+				media.fullImageURL = resolveSiteURL(htmlquery.SelectAttr(link, "href"))
+			}
+			return media, nil
+		case "iframe", "embed":
+			src := htmlquery.SelectAttr(n, "src")
+			if len(src) == 0 {
+				continue
+			}
+			return htmlMedia{node: n, mediaType: mediaTypeVideo, url: resolveSiteURL(src)}, nil
+		case "video":
+			src := htmlquery.SelectAttr(n, "src")
+			if len(src) == 0 {
+				if source := htmlquery.FindOne(n, ".//source[@src]"); source != nil {
+					src = htmlquery.SelectAttr(source, "src")
+				}
+			}
+			if len(src) == 0 {
+				continue
+			}
+			return htmlMedia{node: n, mediaType: mediaTypeVideo, url: resolveSiteURL(src)}, nil
+		case "object":
+			src := htmlquery.SelectAttr(n, "data")
+			if movie := htmlquery.FindOne(n, ".//param[@name='movie' or @name='src']"); movie != nil {
+				src = htmlquery.SelectAttr(movie, "value")
+			}
+			if len(src) == 0 {
+				if embed := htmlquery.FindOne(n, ".//embed[@src]"); embed != nil {
+					src = htmlquery.SelectAttr(embed, "src")
+				}
+			}
+			if len(src) == 0 {
+				continue
+			}
+			return htmlMedia{node: n, mediaType: mediaTypeVideo, url: resolveSiteURL(src)}, nil
+		}
+	}
+	return htmlMedia{}, fieldNotFound("media")
+}
+
+// parentLink returns <a> wrapping the node, if any.
+func parentLink(n *html.Node) *html.Node {
+	for p := n.Parent; p != nil; p = p.Parent {
+		switch p.Data {
+		case "a":
+			if len(htmlquery.SelectAttr(p, "href")) > 0 {
+				return p
+			}
+			return nil
+		case "center", "p", "body", "td":
+			return nil
+		}
+	}
+	return nil
+}
+
+func resolveSiteURL(ref string) string {
+	ref = strings.TrimSpace(ref)
+	base, _ := url.Parse(apodSiteURL)
+	u, err := url.Parse(ref)
+	if err != nil {
+		return apodSiteURL + ref
+	}
+	return base.ResolveReference(u).String()
+}
+
+// Explanation label in APOD and its translated mirrors
+var explanationLabels = []string{"Explanation", "Пояснение", "Explicación", "説明", "說明", "说明", "解説"}
+
+func isLabel(text string) bool {
+	return strings.HasSuffix(text, ":") || strings.HasSuffix(text, "：") || len(explanationLabel(text)) > 0
+}
+
+func explanationLabel(text string) string {
+	for _, label := range explanationLabels {
+		if strings.HasPrefix(text, label) {
+			return label
+		}
+	}
+	return ""
+}
+
+func isBold(n *html.Node) bool {
+	return n.Data == "b" || n.Data == "strong"
+}
+
+// findTitle returns the first bold text between the media and the explanation,
+// or before the explanation if there is no media
+func findTitle(nodes []*html.Node, media *html.Node, explanation *html.Node) string {
+	afterMedia := media == nil
+	for _, n := range nodes {
+		if n == media {
+			afterMedia = true
+			continue
+		}
+		if n == explanation {
+			break
+		}
+		if !afterMedia || !isBold(n) {
+			continue
+		}
+		text := trimSpaces(htmlquery.InnerText(n))
+		if len(text) > 0 && !isLabel(text) {
+			return text
+		}
+	}
+	return ""
+}
+
+// titleFromHead extracts title from "APOD: 2020 January 21 - Title"
+func titleFromHead(doc *html.Node) string {
+	titleNode := htmlquery.FindOne(doc, "//head/title")
+	if titleNode == nil {
+		return ""
+	}
+	text := trimSpaces(htmlquery.InnerText(titleNode))
+	index := strings.Index(text, " - ")
+	if index == -1 {
+		return ""
+	}
+	return strings.TrimSpace(text[index+3:])
+}
+
+func findExplanation(nodes []*html.Node) *html.Node {
+	for _, n := range nodes {
+		if isBold(n) && len(explanationLabel(trimSpaces(htmlquery.InnerText(n)))) > 0 {
+			return n
+		}
+	}
+	return nil
+}
+
+// explanationText collects text following the "Explanation:" label
+// until a block element that isn't one more paragraph of it.
+func explanationText(label *html.Node) string {
+	var b strings.Builder
+	text := trimSpaces(htmlquery.InnerText(label))
+	// Some pages put the text inside the label
+	text = strings.TrimPrefix(text, explanationLabel(text))
+	b.WriteString(strings.TrimPrefix(strings.TrimPrefix(text, ":"), "："))
+	for n := nextInParagraphs(label); n != nil; n = nextInParagraphs(n) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "p":
+				if !isExplanationParagraph(n) {
+					return b.String()
+				}
+				b.WriteString(" ")
+			case "br":
+				b.WriteString(" ")
+			case "center", "hr", "table", "h1", "h2", "h3":
+				return b.String()
+			}
+		}
+		b.WriteString(htmlTextWithBreaks(n))
+	}
+	return b.String()
+}
+
+// nextInParagraphs is the next sibling, going on past the end of a paragraph
+// since the parser closes an open <p> at the start of the next one
+func nextInParagraphs(n *html.Node) *html.Node {
+	if n.NextSibling == nil && n.Parent != nil && n.Parent.Data == "p" {
+		return n.Parent.NextSibling
+	}
+	return n.NextSibling
+}
+
+// isExplanationParagraph tells a paragraph of long explanations from
+// the page footer, which starts with an empty paragraph or a bold label
+func isExplanationParagraph(p *html.Node) bool {
+	if len(trimSpaces(htmlquery.InnerText(p))) == 0 {
+		return false
+	}
+	for _, n := range elements(p) {
+		switch n.Data {
+		case "center", "hr", "table":
+			return false
+		}
+		if isBold(n) && isLabel(trimSpaces(htmlquery.InnerText(n))) {
+			return false
+		}
+	}
+	return true
+}
+
+// htmlTextWithBreaks is inner text with line breaks kept as spaces
+func htmlTextWithBreaks(n *html.Node) string {
+	if n.Type == html.ElementNode && n.Data == "br" {
+		return " "
+	}
+	if n.Type != html.ElementNode {
+		return htmlquery.InnerText(n)
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(htmlTextWithBreaks(c))
+	}
+	return b.String()
+}
+
+// findDate prefers the page date line, then the date in the page title,
+// then any date in the text, explanations may mention other dates first
+func findDate(doc *html.Node) (string, error) {
+	var texts []string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			texts = append(texts, trimSpaces(n.Data))
+		}
+		if n.Type == html.ElementNode && (n.Data == "script" || n.Data == "style") {
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	if body := htmlquery.FindOne(doc, "//body"); body != nil {
+		walk(body)
+	}
+
+	for _, text := range texts {
+		if htmlDateLong.FindString(text) == text || htmlDateShort.FindString(text) == text {
+			if date, ok := parseHTMLDate(text); ok {
+				return date, nil
+			}
+		}
+	}
+	if titleNode := htmlquery.FindOne(doc, "//head/title"); titleNode != nil {
+		if date, ok := parseHTMLDate(htmlquery.InnerText(titleNode)); ok {
+			return date, nil
+		}
+	}
+	for _, text := range texts {
+		if date, ok := parseHTMLDate(text); ok {
+			return date, nil
+		}
+	}
+	return "", fieldNotFound("date")
+}
+
+// parseHTMLDate formats the first date found in text
+func parseHTMLDate(text string) (string, bool) {
+	if match := htmlDateLong.FindString(text); len(match) > 0 {
+		date, err := formatHTMLDate(match, "2006 January 2")
+		return date, err == nil
+	}
+	if match := htmlDateShort.FindString(text); len(match) > 0 {
+		date, err := formatHTMLDate(match, "January 2, 2006")
+		return date, err == nil
+	}
+	return "", false
+}
+
+func formatHTMLDate(text string, layout string) (string, error) {
+	pictureTime, err := time.Parse(layout, strings.Join(strings.Fields(text), " "))
+	if err != nil {
+		return "", &htmlFieldError{"date", err}
+	}
+	return pictureTime.Format("2006-01-02"), nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	userAgent          = "apod-bot (+https://github.com/vox-humana/apod-bot)"
+	defaultHTTPTimeout = 2 * time.Minute
+	defaultHTTPRetries = 3
+	maxRetryDelay      = 30 * time.Second
+	// minUploadRate in bytes per second extends timeout of uploads, so big files can be sent
+	minUploadRate = 256 * 1024
+)
+
+// httpTransport is shared by all requests, main configures it from flags
+var httpTransport = &retryTransport{
+	Next:    http.DefaultTransport,
+	Timeout: defaultHTTPTimeout,
+	Retries: defaultHTTPRetries,
+	Backoff: time.Second,
+}
+
+var httpClient = &http.Client{Transport: httpTransport}
+
+// httpContext cancels all requests, e.g. on SIGTERM
+var httpContext = context.Background()
+
+// retryAfterUnit is the unit of API retry delays, tests shorten it
+var retryAfterUnit = time.Second
+
+// retryTransport sets User-Agent, limits every attempt with Timeout
+// and retries network errors and 5xx responses with exponential backoff
+type retryTransport struct {
+	Next    http.RoundTripper
+	Timeout time.Duration
+	Retries int
+	Backoff time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.roundTrip(req, attempt)
+		if attempt >= t.Retries || !shouldRetry(req, resp, err) {
+			return resp, err
+		}
+		if err != nil {
+			fmt.Println("Request failed, retrying:", err)
+		} else {
+			fmt.Println("Request failed, retrying:", resp.Status)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(retryDelay(t.Backoff, attempt)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+func (t *retryTransport) roundTrip(req *http.Request, attempt int) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := &attemptTimer{cancel: cancel}
+	uploadOfUnknownSize := req.Body != nil && req.Body != http.NoBody && req.ContentLength <= 0
+	if t.Timeout > 0 && !uploadOfUnknownSize {
+		timer.reset(t.Timeout + uploadDuration(req.ContentLength))
+	}
+	attemptReq := req.Clone(ctx)
+	if attempt > 0 && req.Body != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			timer.stop()
+			return nil, err
+		}
+		attemptReq.Body = body
+	}
+	if uploadOfUnknownSize && t.Timeout > 0 {
+		// Timeout starts when the body is sent
+		attemptReq.Body = timeoutAfterEOF{attemptReq.Body, t.Timeout, timer}
+	}
+	if len(attemptReq.Header.Get("User-Agent")) == 0 {
+		attemptReq.Header.Set("User-Agent", userAgent)
+	}
+
+	resp, err := t.Next.RoundTrip(attemptReq)
+	if err != nil {
+		timer.stop()
+		return nil, timer.wrap(err)
+	}
+	// Body may be a big file streamed into an upload, it only has to keep coming
+	if t.Timeout > 0 {
+		timer.reset(t.Timeout)
+	}
+	resp.Body = idleTimeoutBody{resp.Body, t.Timeout, timer}
+	return resp, nil
+}
+
+// uploadDuration is how long the body may take to send at minUploadRate
+func uploadDuration(length int64) time.Duration {
+	if length <= 0 {
+		return 0
+	}
+	return time.Duration(length) * time.Second / minUploadRate
+}
+
+// attemptTimer cancels request attempt when it fires, unlike context deadline it can be moved
+type attemptTimer struct {
+	cancel context.CancelFunc
+	mutex  sync.Mutex
+	timer  *time.Timer
+	fired  bool
+}
+
+func (d *attemptTimer) reset(timeout time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.fired {
+		return
+	}
+	if d.timer == nil {
+		d.timer = time.AfterFunc(timeout, d.fire)
+		return
+	}
+	d.timer.Reset(timeout)
+}
+
+func (d *attemptTimer) fire() {
+	d.mutex.Lock()
+	d.fired = true
+	d.mutex.Unlock()
+	d.cancel()
+}
+
+// stop releases the attempt context
+func (d *attemptTimer) stop() {
+	d.mutex.Lock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.mutex.Unlock()
+	d.cancel()
+}
+
+// wrap reports cancellation by the timer as a timeout
+func (d *attemptTimer) wrap(err error) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err == nil || err == io.EOF || !d.fired {
+		return err
+	}
+	return fmt.Errorf("%w: %v", context.DeadlineExceeded, err)
+}
+
+// timeoutAfterEOF starts the timer once the request body is read
+type timeoutAfterEOF struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *attemptTimer
+}
+
+func (b timeoutAfterEOF) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.timer.reset(b.timeout)
+	}
+	return n, err
+}
+
+// idleTimeoutBody moves the timer while response body is read
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *attemptTimer
+}
+
+func (b idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.timeout > 0 {
+		b.timer.reset(b.timeout)
+	}
+	return n, b.timer.wrap(err)
+}
+
+func (b idleTimeoutBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.timer.stop()
+	return err
+}
+
+// shouldRetry allows retrying idempotent requests after any network error or 5xx,
+// other requests are retried only if they surely haven't been processed
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	// Body can't be sent again
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead ||
+		req.Method == http.MethodPut || req.Method == http.MethodDelete
+	if err != nil {
+		var opErr *net.OpError
+		return idempotent || (errors.As(err, &opErr) && opErr.Op == "dial")
+	}
+	if idempotent {
+		return resp.StatusCode >= http.StatusInternalServerError
+	}
+	// Gateway errors don't tell if the backend got the request,
+	// 503 with Retry-After is a refusal to process it
+	return resp.StatusCode == http.StatusServiceUnavailable && len(resp.Header.Get("Retry-After")) > 0
+}
+
+// retryDelay is exponential backoff with jitter, between delay/2 and delay
+func retryDelay(backoff time.Duration, attempt int) time.Duration {
+	if backoff <= 0 {
+		return 0
+	}
+	delay := backoff << attempt
+	if delay > maxRetryDelay || delay <= 0 {
+		delay = maxRetryDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func newRequest(method string, url string, body io.Reader) (*http.Request, error) {
+	return http.NewRequestWithContext(httpContext, method, url, body)
+}
+
+func httpGet(url string) (*http.Response, error) {
+	req, err := newRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return httpClient.Do(req)
+}
+
+func httpHead(url string) (*http.Response, error) {
+	req, err := newRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return httpClient.Do(req)
+}
+
+func httpPost(url string, contentType string, body io.Reader) (*http.Response, error) {
+	return httpPostLength(url, contentType, body, -1)
+}
+
+// httpPostLength sends streamed body with Content-Length if it's known (not negative),
+// some upload servers don't accept chunked requests
+func httpPostLength(url string, contentType string, body io.Reader, length int64) (*http.Response, error) {
+	req, err := newRequest(http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if length >= 0 {
+		req.ContentLength = length
+	}
+	return httpClient.Do(req)
+}
+
+// multipartBody streams form fields and file without buffering the file,
+// returns body, its content type and length, or -1 if file size is unknown
+func multipartBody(params map[string]string, fileField string, filename string, file io.Reader, size int64) (io.Reader, string, int64, error) {
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := w.WriteField(name, params[name])
+		if err != nil {
+			return nil, "", 0, err
+		}
+	}
+	_, err := w.CreateFormFile(fileField, filename)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	head := bytes.Clone(b.Bytes())
+	b.Reset()
+	err = w.Close()
+	if err != nil {
+		return nil, "", 0, err
+	}
+	tail := b.Bytes()
+
+	length := int64(-1)
+	if size >= 0 {
+		length = int64(len(head)) + size + int64(len(tail))
+	}
+	body := io.MultiReader(bytes.NewReader(head), file, bytes.NewReader(tail))
+	return body, w.FormDataContentType(), length, nil
+}
+
+// sleepContext waits unless requests are canceled
+func sleepContext(d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-httpContext.Done():
+		return httpContext.Err()
+	}
+}
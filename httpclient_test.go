@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryTransport(t *testing.T) {
+	var requests int
+	var userAgents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		body, _ := ioutil.ReadAll(r.Body)
+		if requests < 3 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &retryTransport{http.DefaultTransport, time.Second, 3, time.Millisecond}}
+	resp, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "payload" || requests != 3 {
+		t.Errorf("Expected body to be sent again, got %d %q after %d requests", resp.StatusCode, body, requests)
+	}
+	for _, agent := range userAgents {
+		if agent != userAgent {
+			t.Errorf("Unexpected User-Agent %q", agent)
+		}
+	}
+}
+
+func TestRetryTransportGivesUp(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &retryTransport{http.DefaultTransport, time.Second, 2, time.Millisecond}}
+
+	// POST may have been processed
+	resp, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if requests != 1 {
+		t.Errorf("Expected POST not to be retried, got %d requests", requests)
+	}
+
+	// Backend may have processed request behind gateway
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer gateway.Close()
+	requests = 0
+	resp, err = client.Post(gateway.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || requests != 1 {
+		t.Errorf("Expected POST 502 not to be retried, got %d requests", requests)
+	}
+
+	requests = 0
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || requests != 3 {
+		t.Errorf("Expected 3 attempts, got %d", requests)
+	}
+}
+
+func TestRetryTransportTimeout(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &retryTransport{http.DefaultTransport, 100 * time.Millisecond, 1, time.Millisecond}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" || requests != 2 {
+		t.Errorf("Expected hung request to be retried, got %q after %d requests", body, requests)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	_, err = client.Do(req)
+	if err == nil {
+		t.Error("Expected canceled request to fail")
+	}
+}
+
+// slowReader returns data after delay
+type slowReader struct {
+	data  io.Reader
+	delay time.Duration
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.data.Read(p)
+}
+
+func TestUploadTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &retryTransport{http.DefaultTransport, 50 * time.Millisecond, 0, time.Millisecond}}
+
+	// Sending takes longer than timeout
+	resp, err := client.Post(server.URL, "text/plain", slowReader{strings.NewReader("payload"), 30 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "payload" {
+		t.Errorf("Expected upload of unknown size to finish, got %q (%v)", body, err)
+	}
+
+	if d := uploadDuration(2000 * 1024 * 1024); d != 8000*time.Second {
+		t.Errorf("Unexpected upload duration %v", d)
+	}
+	if uploadDuration(-1) != 0 {
+		t.Error("Unknown length shouldn't extend timeout")
+	}
+}
+
+func TestDownloadIdleTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delay := 20 * time.Millisecond
+		if r.URL.Path == "/stalled" {
+			delay = 200 * time.Millisecond
+		}
+		for i := 0; i < 10; i++ {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			time.Sleep(delay)
+		}
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &retryTransport{http.DefaultTransport, 100 * time.Millisecond, 0, time.Millisecond}}
+
+	// Reading takes longer than timeout, but data keeps coming
+	resp, err := client.Get(server.URL + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || len(body) != 50 {
+		t.Errorf("Expected slow download to finish, got %d bytes (%v)", len(body), err)
+	}
+
+	resp, err = client.Get(server.URL + "/stalled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected stalled download to time out, got %v", err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		delay := retryDelay(time.Second, attempt)
+		if delay < max/2 || delay > max {
+			t.Errorf("Delay %v of attempt %d isn't in [%v, %v]", delay, attempt, max/2, max)
+		}
+	}
+	if delay := retryDelay(time.Second, 100); delay > maxRetryDelay {
+		t.Errorf("Delay %v exceeds %v", delay, maxRetryDelay)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// mediaLimits describes what a platform accepts, zero means no limit
+type mediaLimits struct {
+	MaxLength       int64
+	MaxDimension    int
+	MaxDimensionSum int
+}
+
+var (
+	// https://core.telegram.org/bots/api#sendphoto
+	tgPhotoLimits    = mediaLimits{MaxLength: 10 * 1024 * 1024, MaxDimensionSum: 10000}
+	tgDocumentLimits = mediaLimits{MaxLength: tgMaxFileLength}
+	ttImageLimits    = mediaLimits{MaxLength: 10 * 1024 * 1024, MaxDimension: 8192}
+	ttVideoLimits    = mediaLimits{MaxLength: ttMaxVideoLength}
+)
+
+var jpegQualities = []int{90, 80, 70, 60}
+
+func (l mediaLimits) fitsLength(length int64) bool {
+	return l.MaxLength == 0 || length <= l.MaxLength
+}
+
+func (l mediaLimits) fitsSize(width, height int) bool {
+	if l.MaxDimension > 0 && (width > l.MaxDimension || height > l.MaxDimension) {
+		return false
+	}
+	return l.MaxDimensionSum == 0 || width+height <= l.MaxDimensionSum
+}
+
+// scaledSize returns the largest size with the same aspect ratio satisfying dimension limits
+func (l mediaLimits) scaledSize(width, height int) (int, int) {
+	scale := 1.0
+	if l.MaxDimension > 0 && width > l.MaxDimension {
+		scale = math.Min(scale, float64(l.MaxDimension)/float64(width))
+	}
+	if l.MaxDimension > 0 && height > l.MaxDimension {
+		scale = math.Min(scale, float64(l.MaxDimension)/float64(height))
+	}
+	if l.MaxDimensionSum > 0 && width+height > l.MaxDimensionSum {
+		scale = math.Min(scale, float64(l.MaxDimensionSum)/float64(width+height))
+	}
+	return scaleSize(width, height, scale)
+}
+
+func scaleSize(width, height int, scale float64) (int, int) {
+	w := int(math.Floor(float64(width) * scale))
+	h := int(math.Floor(float64(height) * scale))
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// Media kinds expected in downloaded responses
+const (
+	mediaKindImage = "image"
+	mediaKindVideo = "video"
+	// Document is any file but a text page, e.g. TIFF or PDF
+	mediaKindDocument = "document"
+)
+
+// Sane image dimensions, anything smaller is a placeholder
+// and bigger can't be decoded to resize it, RGBA PNG of this size takes 400 MB
+const (
+	minImageDimension = 16
+	maxImagePixels    = 100 * 1000 * 1000
+)
+
+// errInvalidMedia means the server responded with something else than the media,
+// e.g. an HTML error page with 200 status
+var errInvalidMedia = errors.New("Invalid media")
+
+// fitImageBody returns image body to upload and its length, -1 if unknown.
+// Image that fits limits is streamed as is, image of unknown length is read
+// up to the length limit to find out. Others are downloaded and shrunk
+func fitImageBody(body io.Reader, length int64, config image.Config, filename string, limits mediaLimits) (io.Reader, int64, string, error) {
+	fits := limits.fitsSize(config.Width, config.Height)
+	if fits && length < 0 && limits.MaxLength > 0 {
+		head, err := ioutil.ReadAll(io.LimitReader(body, limits.MaxLength+1))
+		if err != nil {
+			return nil, 0, "", err
+		}
+		if int64(len(head)) <= limits.MaxLength {
+			return bytes.NewReader(head), int64(len(head)), filename, nil
+		}
+		fits = false
+		body = io.MultiReader(bytes.NewReader(head), body)
+	}
+	if fits && limits.fitsLength(length) {
+		return body, length, filename, nil
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	data, filename, err = fitImage(data, filename, limits)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	return bytes.NewReader(data), int64(len(data)), filename, nil
+}
+
+// remoteMedia downloads checked media, it's downloaded again if upload has to be repeated
+type remoteMedia struct {
+	url  string
+	kind string
+	resp *http.Response
+}
+
+// open returns media body, image size and body length, -1 if unknown
+func (m *remoteMedia) open() (io.Reader, image.Config, int64, error) {
+	m.Close()
+	resp, err := httpGet(m.url)
+	if err != nil {
+		return nil, image.Config{}, 0, err
+	}
+	err = checkResponseStatus(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, image.Config{}, 0, err
+	}
+	body, config, err := checkMedia(resp, m.kind)
+	if err != nil {
+		resp.Body.Close()
+		return nil, image.Config{}, 0, fmt.Errorf("%s: %w", m.url, err)
+	}
+	m.resp = resp
+	return body, config, resp.ContentLength, nil
+}
+
+func (m *remoteMedia) Close() {
+	if m.resp != nil {
+		m.resp.Body.Close()
+		m.resp = nil
+	}
+}
+
+// checkMedia checks that response content is the media kind before it's sent to subscribers.
+// Returns the body to read instead of resp.Body, it includes the checked bytes,
+// and image size
+func checkMedia(resp *http.Response, kind string) (io.Reader, image.Config, error) {
+	err := checkContentType(resp.Header.Get("Content-Type"), kind)
+	if err != nil {
+		return nil, image.Config{}, err
+	}
+
+	var head bytes.Buffer
+	body := io.TeeReader(resp.Body, &head)
+	var config image.Config
+	if kind == mediaKindImage {
+		config, _, err = image.DecodeConfig(body)
+		if err != nil {
+			return nil, config, fmt.Errorf("%w, can't decode image: %v", errInvalidMedia, err)
+		}
+		err = checkImageConfig(config)
+		if err != nil {
+			return nil, image.Config{}, err
+		}
+	} else {
+		_, err := io.CopyN(io.Discard, body, 512)
+		if err != nil && err != io.EOF {
+			return nil, image.Config{}, err
+		}
+		sniffed := http.DetectContentType(head.Bytes())
+		if strings.HasPrefix(sniffed, "text/") {
+			return nil, config, fmt.Errorf("%w, content is %s", errInvalidMedia, sniffed)
+		}
+	}
+	return io.MultiReader(&head, resp.Body), config, nil
+}
+
+// checkContentType allows the media kind and unspecific types, content is checked anyway
+func checkContentType(contentType string, kind string) error {
+	if len(contentType) == 0 {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("%w, bad Content-Type %s: %v", errInvalidMedia, contentType, err)
+	}
+	if strings.HasPrefix(mediaType, kind+"/") || mediaType == "application/octet-stream" || mediaType == "binary/octet-stream" {
+		return nil
+	}
+	if kind == mediaKindDocument && !strings.HasPrefix(mediaType, "text/") {
+		return nil
+	}
+	return fmt.Errorf("%w, Content-Type %s isn't %s", errInvalidMedia, mediaType, kind)
+}
+
+func checkImageConfig(config image.Config) error {
+	if config.Width < minImageDimension || config.Height < minImageDimension ||
+		int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return fmt.Errorf("%w, unexpected image size %dx%d", errInvalidMedia, config.Width, config.Height)
+	}
+	return nil
+}
+
+// fitImage downsizes and recompresses image to satisfy limits.
+// Returns the original data if it already fits.
+func fitImage(data []byte, filename string, limits mediaLimits) ([]byte, string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	err = checkImageConfig(config)
+	if err != nil {
+		return nil, "", err
+	}
+	if limits.fitsLength(int64(len(data))) && limits.fitsSize(config.Width, config.Height) {
+		return data, filename, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	width, height := limits.scaledSize(config.Width, config.Height)
+	jpegFilename := strings.TrimSuffix(filename, path.Ext(filename)) + ".jpg"
+	for attempt := 0; attempt < 5; attempt++ {
+		resized := resizeImage(img, width, height)
+		for _, quality := range jpegQualities {
+			var b bytes.Buffer
+			err = jpeg.Encode(&b, resized, &jpeg.Options{Quality: quality})
+			if err != nil {
+				return nil, "", err
+			}
+			if limits.fitsLength(int64(b.Len())) {
+				fmt.Printf("Image %s resized from %dx%d (%d bytes) to %dx%d (%d bytes, quality %d)\n",
+					filename, config.Width, config.Height, len(data), width, height, b.Len(), quality)
+				return b.Bytes(), jpegFilename, nil
+			}
+			// Lower quality won't help much for way too big images
+			if float64(b.Len()) > 2*float64(limits.MaxLength) {
+				break
+			}
+		}
+		// JPEG size is roughly proportional to the number of pixels
+		width, height = scaleSize(width, height, 0.7)
+	}
+	return nil, "", errors.New("Can't fit image " + filename + " into limits")
+}
+
+// resizeImage scales image down using area averaging,
+// pixels are read from the decoded image without converting it first
+func resizeImage(src image.Image, width, height int) image.Image {
+	bounds := src.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	if srcWidth == width && srcHeight == height {
+		return src
+	}
+
+	pixel := pixelReader(src)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * srcHeight / height
+		y1 := (y + 1) * srcHeight / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := x * srcWidth / width
+			x1 := (x + 1) * srcWidth / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := pixel(bounds.Min.X+sx, bounds.Min.Y+sy)
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+				}
+				count += uint64(x1 - x0)
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / count), uint8(g / count), uint8(b / count), uint8(a / count)})
+		}
+	}
+	return dst
+}
+
+// pixelReader returns 8-bit premultiplied color of a pixel,
+// JPEG and RGBA pixels are read directly
+func pixelReader(src image.Image) func(x, y int) (r, g, b, a uint32) {
+	switch img := src.(type) {
+	case *image.YCbCr:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			r, g, b := color.YCbCrToRGB(img.Y[img.YOffset(x, y)], img.Cb[img.COffset(x, y)], img.Cr[img.COffset(x, y)])
+			return uint32(r), uint32(g), uint32(b), 0xff
+		}
+	case *image.RGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			i := img.PixOffset(x, y)
+			return uint32(img.Pix[i]), uint32(img.Pix[i+1]), uint32(img.Pix[i+2]), uint32(img.Pix[i+3])
+		}
+	}
+	return func(x, y int) (uint32, uint32, uint32, uint32) {
+		r, g, b, a := src.At(x, y).RGBA()
+		return r >> 8, g >> 8, b >> 8, a >> 8
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestFitImage(t *testing.T) {
+	data := noiseImage(600, 400)
+
+	fitted, filename, err := fitImage(data, "noise.png", mediaLimits{MaxLength: int64(len(data)) * 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename != "noise.png" || !bytes.Equal(fitted, data) {
+		t.Error("Image within limits shouldn't be changed")
+	}
+
+	limits := mediaLimits{MaxLength: 50 * 1024, MaxDimensionSum: 500}
+	fitted, filename, err = fitImage(data, "noise.png", limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename != "noise.jpg" {
+		t.Error("Recompressed image should be JPEG, got", filename)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(fitted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "jpeg" {
+		t.Error("Unexpected format", format)
+	}
+	if !limits.fitsLength(int64(len(fitted))) || !limits.fitsSize(config.Width, config.Height) {
+		t.Errorf("Image %dx%d (%d bytes) doesn't fit limits", config.Width, config.Height, len(fitted))
+	}
+	if diff := config.Width*400 - config.Height*600; diff > 600 || diff < -600 {
+		t.Errorf("Aspect ratio isn't preserved: %dx%d", config.Width, config.Height)
+	}
+}
+
+func TestFitImageBody(t *testing.T) {
+	data := noiseImage(600, 400)
+	config := image.Config{Width: 600, Height: 400}
+	limits := mediaLimits{MaxLength: int64(len(data))}
+
+	body := bytes.NewReader(data)
+	fitted, length, _, err := fitImageBody(body, int64(len(data)), config, "noise.png", limits)
+	if err != nil || fitted != io.Reader(body) || length != int64(len(data)) {
+		t.Errorf("Image of known length within limits should be streamed, got %d bytes (%v)", length, err)
+	}
+
+	fitted, length, filename, err := fitImageBody(bytes.NewReader(data), -1, config, "noise.png", limits)
+	if err != nil || length != int64(len(data)) || filename != "noise.png" {
+		t.Fatalf("Image of unknown length within limits shouldn't be changed, got %s %d bytes (%v)", filename, length, err)
+	}
+	if read, _ := ioutil.ReadAll(fitted); !bytes.Equal(read, data) {
+		t.Error("Image of unknown length within limits changed")
+	}
+
+	limits.MaxLength = 50 * 1024
+	fitted, length, filename, err = fitImageBody(bytes.NewReader(data), -1, config, "noise.png", limits)
+	if err != nil || filename != "noise.jpg" || length > limits.MaxLength {
+		t.Fatalf("Image of unknown length over limits should be shrunk, got %s %d bytes (%v)", filename, length, err)
+	}
+	if read, _ := ioutil.ReadAll(fitted); int64(len(read)) != length {
+		t.Errorf("Expected %d bytes, got %d", length, len(read))
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	src := image.NewYCbCr(image.Rect(0, 0, 40, 20), image.YCbCrSubsampleRatio420)
+	for i := range src.Y {
+		src.Y[i] = 200
+	}
+	for i := range src.Cb {
+		src.Cb[i], src.Cr[i] = 128, 128
+	}
+	resized := resizeImage(src, 20, 10)
+	if bounds := resized.Bounds(); bounds.Dx() != 20 || bounds.Dy() != 10 {
+		t.Fatalf("Unexpected size %v", bounds)
+	}
+	if r, g, b, a := resized.At(5, 5).RGBA(); r>>8 != 200 || g>>8 != 200 || b>>8 != 200 || a>>8 != 255 {
+		t.Errorf("Unexpected color %d %d %d %d", r>>8, g>>8, b>>8, a>>8)
+	}
+	if resizeImage(src, 40, 20) != image.Image(src) {
+		t.Error("Image of the same size shouldn't be copied")
+	}
+}
+
+func TestScaledSize(t *testing.T) {
+	tests := []struct {
+		limits        mediaLimits
+		width, height int
+		expectedW     int
+		expectedH     int
+	}{
+		{mediaLimits{}, 4000, 3000, 4000, 3000},
+		{mediaLimits{MaxDimensionSum: 10000}, 12000, 8000, 6000, 4000},
+		{mediaLimits{MaxDimension: 2000}, 3000, 6000, 1000, 2000},
+	}
+	for _, test := range tests {
+		w, h := test.limits.scaledSize(test.width, test.height)
+		if w != test.expectedW || h != test.expectedH {
+			t.Errorf("%v %dx%d: expected %dx%d, got %dx%d", test.limits, test.width, test.height, test.expectedW, test.expectedH, w, h)
+		}
+	}
+}
+
+func TestCheckMedia(t *testing.T) {
+	noise := noiseImage(64, 48)
+	html := []byte("<!DOCTYPE html><html><body>404 Not Found</body></html>")
+	tests := []struct {
+		kind        string
+		contentType string
+		body        []byte
+		valid       bool
+	}{
+		{mediaKindImage, "image/png", noise, true},
+		{mediaKindImage, "", noise, true},
+		{mediaKindImage, "application/octet-stream", noise, true},
+		{mediaKindImage, "text/html; charset=utf-8", noise, false},
+		{mediaKindImage, "image/jpeg", html, false},
+		{mediaKindImage, "image/png", noiseImage(8, 8), false},
+		{mediaKindVideo, "video/mp4", []byte("\x00\x00\x00\x18ftypmp42"), true},
+		{mediaKindVideo, "video/mp4", html, false},
+		{mediaKindVideo, "image/jpeg", []byte("\x00\x00\x00\x18ftypmp42"), false},
+		{mediaKindDocument, "image/tiff", []byte("II*\x00\x08\x00\x00\x00"), true},
+		{mediaKindDocument, "application/pdf", []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3"), true},
+		{mediaKindDocument, "text/html", []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3"), false},
+		{mediaKindDocument, "application/pdf", html, false},
+	}
+	for _, test := range tests {
+		resp := &http.Response{Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader(test.body))}
+		resp.Header.Set("Content-Type", test.contentType)
+		body, _, err := checkMedia(resp, test.kind)
+		if !test.valid {
+			if !errors.Is(err, errInvalidMedia) {
+				t.Errorf("%s %s %.10q: expected invalid media, got %v", test.kind, test.contentType, test.body, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: %v", test.kind, test.contentType, err)
+			continue
+		}
+		// Checked bytes aren't lost
+		data, err := ioutil.ReadAll(body)
+		if err != nil || !bytes.Equal(data, test.body) {
+			t.Errorf("%s %s: body changed (%v)", test.kind, test.contentType, err)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// lockFile is a no-op where flock isn't available
+func lockFile(filePath string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/antchfx/htmlquery"
+	"golang.org/x/net/html/charset"
+)
+
+// apodMirror is a translated APOD edition with ap%s.html pages,
+// only title and explanation are taken from it, media comes from NASA
+type apodMirror struct {
+	Language string
+	PageURL  string
+	// Charset is used if the server doesn't send one, old mirrors often have wrong meta tags
+	Charset string
+}
+
+// Known mirrors by name, add one together with a page recorded from it into test_data.
+// -mirror also accepts a page URL template like https://example.com/apod/ap%s.html
+var apodMirrors = map[string]apodMirror{}
+
+// findMirror returns a known mirror by name or a custom one by its page URL template
+func findMirror(name string, language string) (apodMirror, error) {
+	if mirror, ok := apodMirrors[name]; ok {
+		if len(language) > 0 && language != mirror.Language {
+			return mirror, fmt.Errorf("Mirror %s is in %s, not %s", name, mirror.Language, language)
+		}
+		return mirror, nil
+	}
+	if !strings.Contains(name, "%s") {
+		return apodMirror{}, fmt.Errorf("Unknown mirror: %s", name)
+	}
+	if len(language) == 0 {
+		return apodMirror{}, errors.New("Custom mirror requires -lang")
+	}
+	return apodMirror{Language: language, PageURL: name}, nil
+}
+
+// mirrorTranslator takes translations from the mirror and asks the next
+// translator if the mirror is in another language or hasn't published the page yet
+type mirrorTranslator struct {
+	Mirror apodMirror
+	Next   Translator
+}
+
+func (t mirrorTranslator) Translate(p picture, language string) (Translation, error) {
+	if language != t.Mirror.Language {
+		return t.next(p, language, fmt.Errorf("Mirror is in %s", t.Mirror.Language))
+	}
+	translation, err := mirrorTranslation(t.Mirror, p.Date)
+	if err != nil {
+		return t.next(p, language, err)
+	}
+	fmt.Println("Using translation from", t.Mirror.PageURL)
+	return translation, nil
+}
+
+func (t mirrorTranslator) next(p picture, language string, err error) (Translation, error) {
+	if t.Next == nil {
+		return Translation{}, err
+	}
+	logWarning("Mirror translation isn't available:", err)
+	return t.Next.Translate(p, language)
+}
+
+func mirrorTranslation(mirror apodMirror, date string) (Translation, error) {
+	pictureTime, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return Translation{}, err
+	}
+	resp, err := httpGet(fmt.Sprintf(mirror.PageURL, pictureTime.Format("060102")))
+	if err != nil {
+		return Translation{}, err
+	}
+	defer resp.Body.Close()
+
+	fmt.Println("APOD mirror response:", resp.StatusCode)
+	err = checkResponseStatus(resp)
+	if err != nil {
+		return Translation{}, err
+	}
+	return makeTranslationFromHTML(resp.Body, mirrorContentType(resp.Header.Get("Content-Type"), mirror.Charset))
+}
+
+// mirrorContentType adds the mirror charset if the server doesn't send one,
+// it takes precedence over a charset declared in the page
+func mirrorContentType(contentType string, fallback string) string {
+	_, params, _ := mime.ParseMediaType(contentType)
+	if len(params["charset"]) > 0 || len(fallback) == 0 {
+		return contentType
+	}
+	return "text/html; charset=" + fallback
+}
+
+// makeTranslationFromHTML parses title and explanation of a mirror page
+func makeTranslationFromHTML(reader io.Reader, contentType string) (Translation, error) {
+	utf8Reader, err := charset.NewReader(reader, contentType)
+	if err != nil {
+		return Translation{}, err
+	}
+	doc, err := htmlquery.Parse(utf8Reader)
+	if err != nil {
+		return Translation{}, err
+	}
+	nodes := elements(doc)
+
+	explanationNode := findExplanation(nodes)
+	if explanationNode == nil {
+		return Translation{}, fieldNotFound("explanation")
+	}
+	// Mirrors may embed media differently, title is searched before the explanation then
+	media, _ := findMedia(nodes)
+	title := findTitle(nodes, media.node, explanationNode)
+	if len(title) == 0 {
+		title = findTitle(nodes, nil, explanationNode)
+	}
+	if len(title) == 0 {
+		title = titleFromHead(doc)
+	}
+	if len(title) == 0 {
+		return Translation{}, fieldNotFound("title")
+	}
+
+	translation := Translation{
+		Title:       title,
+		Explanation: trimSpaces(explanationText(explanationNode)),
+	}
+	return translation, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mirrorStandIn serves test_data/mirror-<language>-ap*.html pages without charset in Content-Type
+func mirrorStandIn(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		language, page := filepath.Split(strings.TrimPrefix(r.URL.Path, "/"))
+		body, err := ioutil.ReadFile(filepath.Join("test_data", "mirror-"+strings.TrimSuffix(language, "/")+"-"+page))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMirrorTranslation(t *testing.T) {
+	server := mirrorStandIn(t)
+	tests := []struct {
+		mirror   apodMirror
+		expected Translation
+	}{
+		{apodMirror{"zh-TW", server.URL + "/zh/ap%s.html", "big5"}, Translation{
+			Title:       "蝌蚪星雲裡的恆星形成",
+			Explanation: "蝌蚪星雲裡 有什麼騷動？ 恆星正在形成。",
+		}},
+		{apodMirror{"ru", server.URL + "/ru/ap%s.html", ""}, Translation{
+			Title:       "Звездообразование в туманности Головастик",
+			Explanation: "Что за суматоха в туманности Головастик? Звездообразование.",
+		}},
+	}
+
+	for _, test := range tests {
+		translation, err := mirrorTranslation(test.mirror, "2020-01-28")
+		if err != nil {
+			t.Error(test.mirror.Language, err)
+			continue
+		}
+		if translation != test.expected {
+			t.Errorf("Expected %v, got %v", test.expected, translation)
+		}
+	}
+}
+
+func TestMirrorTranslator(t *testing.T) {
+	server := mirrorStandIn(t)
+	mirror, err := findMirror(server.URL+"/ru/ap%s.html", "ru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback := overrideTranslator{filepath.Join(t.TempDir(), "missing.json"), nil}
+	translator := mirrorTranslator{mirror, fallback}
+
+	p := postedPicture()
+	translation, err := translator.Translate(p, "ru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if translation.Title != "Звездообразование в туманности Головастик" {
+		t.Errorf("Unexpected translation %v", translation)
+	}
+
+	// Mirror hasn't published the page yet
+	p.Date = "2020-01-29"
+	_, err = translator.Translate(p, "ru")
+	if err != errTranslationNotFound {
+		t.Errorf("Expected fallback translator error, got %v", err)
+	}
+
+	apodMirrors["zh-tw"] = apodMirror{"zh-TW", server.URL + "/zh/ap%s.html", "big5"}
+	defer delete(apodMirrors, "zh-tw")
+	if _, err = findMirror("zh-tw", ""); err != nil {
+		t.Error("Expected known mirror, got", err)
+	}
+	_, err = findMirror("zh-tw", "ru")
+	if err == nil {
+		t.Error("Expected language mismatch error")
+	}
+	_, err = findMirror("ru", "")
+	if err == nil {
+		t.Error("Expected unknown mirror error")
+	}
+	_, err = findMirror("https://example.com/ap%s.html", "")
+	if err == nil {
+		t.Error("Expected error for custom mirror without language")
+	}
+}
@@ -2,15 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"path"
 	"regexp"
 	"strings"
 	"time"
-
-	"github.com/antchfx/htmlquery"
 )
 
 type picture struct {
@@ -21,66 +22,84 @@ type picture struct {
 	MediaType    string `json:"media_type"`
 	FullImageURL string `json:"hdurl"`
 	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
 	Link         string
 }
 
-func makePictureFromHTML(reader io.Reader, p *picture) error {
-	doc, err := htmlquery.Parse(reader)
-	if err != nil {
-		return err
+var errInvalidPicture = errors.New("Invalid picture")
+
+// pictureFieldError reports which field makes the picture impossible to post
+type pictureFieldError struct {
+	Field  string
+	Reason string
+}
+
+func (e *pictureFieldError) Error() string {
+	return fmt.Sprintf("Invalid picture %s: %s", e.Field, e.Reason)
+}
+
+func (e *pictureFieldError) Unwrap() error {
+	return errInvalidPicture
+}
+
+// Validate checks the picture can be posted and drops broken optional URLs,
+// so senders receive only well-formed pictures
+func (p *picture) Validate() error {
+	if _, err := time.Parse("2006-01-02", p.Date); err != nil {
+		return &pictureFieldError{"date", fmt.Sprintf("%q isn't YYYY-MM-DD", p.Date)}
 	}
-	titleNode, err := htmlquery.Query(doc, "//html/body/center[2]/b[1]")
-	if err != nil {
-		return err
+	if len(p.Title) == 0 {
+		return &pictureFieldError{"title", "empty"}
 	}
-	title := htmlquery.InnerText(titleNode)
-
-	explanationNode, err := htmlquery.Query(doc, "//html/body/p[1]")
-	if err != nil {
-		return err
+	if len(p.Explanation) == 0 {
+		return &pictureFieldError{"explanation", "empty"}
 	}
-	explanation := htmlquery.InnerText(explanationNode)
-	explanation = strings.Replace(explanation, "Explanation:", "", 1)
-
-	imageNode, err := htmlquery.Query(doc, "//html/body/center[1]/p[2]/a/img")
-	fullImageURL := ""
-	imageURL := ""
-	mediaType := mediaTypeImage
-	if imageNode == nil {
-		// try video
-		imageNode, err = htmlquery.Query(doc, "//html/body/center[1]/p[2]/iframe")
-		if imageNode == nil {
-			return err
+	switch p.MediaType {
+	case mediaTypeImage, mediaTypeVideo:
+		if !isWebURL(p.URL) {
+			return &pictureFieldError{"url", fmt.Sprintf("%q isn't a web URL", p.URL)}
 		}
-		mediaType = mediaTypeVideo
-		imageURL = htmlquery.SelectAttr(imageNode, "src")
-	} else {
-		imageURL = apodSiteURL + htmlquery.SelectAttr(imageNode, "src")
-		fullImageNode, err := htmlquery.Query(doc, "//html/body/center[1]/p[2]/a")
-		if err != nil {
-			return err
+	case mediaTypeOther:
+		// Only the APOD page link is posted then
+		if len(p.URL) > 0 && !isWebURL(p.URL) {
+			logWarning("Ignoring broken url", p.URL)
+			p.URL = ""
 		}
-		fullImageURL = apodSiteURL + htmlquery.SelectAttr(fullImageNode, "href")
+	default:
+		return &pictureFieldError{"media_type", fmt.Sprintf("%q isn't supported", p.MediaType)}
 	}
 
-	dateNode, err := htmlquery.Query(doc, "//html/body/center[1]/p[2]")
-	dateText := trimSpaces(htmlquery.InnerText(dateNode))
-	pictureTime, err := time.Parse("2006 January 2", dateText)
-	if err != nil {
-		return err
+	if len(p.FullImageURL) > 0 && !isWebURL(p.FullImageURL) {
+		logWarning("Ignoring broken hdurl", p.FullImageURL)
+		p.FullImageURL = ""
+	}
+	if p.MediaType == mediaTypeImage && len(p.FullImageURL) == 0 {
+		fmt.Println("No full resolution image, posting only the preview")
+	}
+	if len(p.ThumbnailURL) > 0 && !isWebURL(p.ThumbnailURL) {
+		logWarning("Ignoring broken thumbnail_url", p.ThumbnailURL)
+		p.ThumbnailURL = ""
 	}
-	pictureDate := pictureTime.Format("2006-01-02")
-
-	p.Title = title
-	p.Explanation = explanation
-	p.URL = imageURL
-	p.FullImageURL = fullImageURL
-	p.MediaType = mediaType
-	p.Date = pictureDate
-	p.trim()
 	return nil
 }
 
+// previewURL returns a screenshot or thumbnail of other media, empty if there isn't any
+func previewURL(p picture) string {
+	if len(p.ThumbnailURL) > 0 {
+		return p.ThumbnailURL
+	}
+	switch fileExtension(p.URL) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return p.URL
+	}
+	return ""
+}
+
+func isWebURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) > 0
+}
+
 func makePictureFromAPI(reader io.Reader, p *picture) error {
 	body, err := ioutil.ReadAll(reader)
 	if err != nil {
@@ -92,11 +111,45 @@ func makePictureFromAPI(reader io.Reader, p *picture) error {
 		return err
 	}
 
+	// API sometimes marks self-hosted videos as "other"
+	if isVideoFile(p.URL) {
+		p.MediaType = mediaTypeVideo
+	}
 	p.removeAds()
 	p.trim()
 	return nil
 }
 
+func fileExtension(fileURL string) string {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(path.Ext(u.Path))
+}
+
+// isVideoFile reports whether URL points to a video file rather than an embedded player
+func isVideoFile(fileURL string) bool {
+	switch fileExtension(fileURL) {
+	case ".mp4", ".m4v", ".mov", ".webm":
+		return true
+	}
+	return false
+}
+
+func isAnimationFile(fileURL string) bool {
+	return fileExtension(fileURL) == ".gif"
+}
+
+// isResizableImage reports whether the image can be decoded to fit it into limits
+func isResizableImage(fileURL string) bool {
+	switch fileExtension(fileURL) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	}
+	return false
+}
+
 func (p *picture) removeAds() {
 	adStartIndex := strings.Index(p.Explanation, "   ")
 	if adStartIndex != -1 {
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+const defaultWorkers = 4
+
+// workerPool limits how many tasks run at once.
+// Tasks of a pool mustn't wait for the same pool, it may deadlock
+type workerPool chan struct{}
+
+func newWorkerPool(size int) workerPool {
+	if size < 1 {
+		size = 1
+	}
+	return make(workerPool, size)
+}
+
+// Run runs tasks concurrently and waits for all of them,
+// errors are joined in the order of tasks
+func (p workerPool) Run(tasks ...func() error) error {
+	errs := make([]error, len(tasks))
+	var wg sync.WaitGroup
+	for i, task := range tasks {
+		wg.Add(1)
+		go func(i int, task func() error) {
+			defer wg.Done()
+			p <- struct{}{}
+			defer func() { <-p }()
+			errs[i] = task()
+		}(i, task)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// uploadPool bounds concurrent media downloads and uploads
+var uploadPool = newWorkerPool(defaultWorkers)
+
+// deliveryPools bound concurrent deliveries per service, messengers limit request rate per bot
+var deliveryPools = map[string]workerPool{
+	"tg": newWorkerPool(defaultWorkers),
+	"tt": newWorkerPool(2),
+}
+
+func deliveryPool(service string) workerPool {
+	pool, ok := deliveryPools[service]
+	if !ok {
+		return newWorkerPool(1)
+	}
+	return pool
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	pool := newWorkerPool(2)
+	var running, maxRunning int32
+	tasks := make([]func() error, 6)
+	for i := range tasks {
+		i := i
+		tasks[i] = func() error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			if i%3 == 0 {
+				return errors.New("task failed")
+			}
+			return nil
+		}
+	}
+
+	err := pool.Run(tasks...)
+	if maxRunning != 2 {
+		t.Errorf("Expected 2 concurrent tasks, got %d", maxRunning)
+	}
+	if err == nil || err.Error() != "task failed\ntask failed" {
+		t.Errorf("Expected joined errors, got %v", err)
+	}
+	if err = pool.Run(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errMessageNotFound means the message has been deleted already, e.g. by hand
+var errMessageNotFound = errors.New("Message not found")
+
+// retract deletes messages posted for the date from every chat concurrently
+// and rolls the state back, so the date can be posted again
+func retract(store stateStore, service string, token string, date string) error {
+	if len(date) == 0 {
+		return errors.New("Date is required to retract")
+	}
+
+	var deliveries []Delivery
+	err := store.View(func(tx stateTx) error {
+		all, err := tx.Deliveries(service)
+		if err != nil {
+			return err
+		}
+		for _, delivery := range all {
+			if delivery.Date == date {
+				deliveries = append(deliveries, delivery)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(deliveries) == 0 {
+		return errors.New("Nothing was posted for " + date)
+	}
+
+	tasks := make([]func() error, len(deliveries))
+	for i, delivery := range deliveries {
+		delivery := delivery
+		tasks[i] = func() error {
+			var err error
+			switch service {
+			case "tg":
+				err = tgDelete(delivery, token)
+			default:
+				err = ttDelete(delivery, token)
+			}
+			if err != nil {
+				return fmt.Errorf("Can't retract from %d: %w", delivery.Chat, err)
+			}
+			err = rollbackDelivery(store, delivery)
+			if err != nil {
+				return err
+			}
+			fmt.Println("Retracted", date, "from", delivery.Chat)
+			return nil
+		}
+	}
+	return deliveryPool(service).Run(tasks...)
+}
+
+// rollbackDelivery forgets the delivery and restores the previous sent date
+func rollbackDelivery(store stateStore, delivery Delivery) error {
+	return store.Update(func(tx stateTx) error {
+		err := tx.DeleteDelivery(delivery.Service, delivery.ID)
+		if err != nil {
+			return err
+		}
+		lastDate, err := tx.LastSentDate(delivery.Service)
+		if err != nil || lastDate != delivery.Date {
+			return err
+		}
+
+		deliveries, err := tx.Deliveries(delivery.Service)
+		if err != nil {
+			return err
+		}
+		previousDate := ""
+		for _, d := range deliveries {
+			if d.Date > previousDate && d.Date != delivery.Date {
+				previousDate = d.Date
+			}
+		}
+		return tx.SetLastSentDate(delivery.Service, previousDate)
+	})
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"io"
+	"net/http"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -73,3 +77,175 @@ func TestImage(t *testing.T) {
 		t.Errorf("\n%v\nis not equal to\n%v", apiPicture, htmlPicture)
 	}
 }
+
+func TestHTMLLayouts(t *testing.T) {
+	tests := []struct {
+		file     string
+		expected picture
+	}{
+		{"ap950622.html", picture{
+			Date:         "1995-06-22",
+			Explanation:  "A view of the Earth rising over the lunar limb taken from Apollo 8.",
+			Title:        "Earth Rise",
+			MediaType:    mediaTypeImage,
+			FullImageURL: "https://apod.nasa.gov/apod/image/earthrise_big.gif",
+			URL:          "https://apod.nasa.gov/apod/image/earthrise.gif",
+		}},
+		{"ap030815.html", picture{
+			Date:        "2003-08-15",
+			Explanation: "As Mars approaches, its surface features rotate into view.",
+			Title:       "Mars Rotates",
+			MediaType:   mediaTypeVideo,
+			URL:         "https://apod.nasa.gov/apod/image/0308/marsrotates.swf",
+		}},
+		{"ap230905.html", picture{
+			Date:        "2023-09-05",
+			Explanation: "What's happening to our Sun? A prominence is erupting.",
+			Title:       "A Solar Prominence Erupts",
+			MediaType:   mediaTypeVideo,
+			URL:         "https://apod.nasa.gov/apod/image/2309/prominence_sdo.mp4",
+		}},
+		{"layout-paragraphs.html", picture{
+			Date: "2007-09-13",
+			Explanation: "The comet's ion tail points away from the Sun. Its dust tail curves along the orbit. " +
+				"In the second paragraph, the tails are compared. Note: the nucleus itself is too small to see.",
+			Title:        "Paragraphs of a Comet",
+			MediaType:    mediaTypeImage,
+			FullImageURL: "https://apod.nasa.gov/apod/image/0709/comet_big.jpg",
+			URL:          "https://apod.nasa.gov/apod/image/0709/comet.jpg",
+		}},
+		{"layout-date-in-text.html", picture{
+			Date:         "2017-08-18",
+			Explanation:  "On 2006 March 29 the Moon's shadow fell on Earth. Its next total eclipse path sweeps the United States on August 21, 2017.",
+			Title:        "Shadow of an Eclipse",
+			MediaType:    mediaTypeImage,
+			FullImageURL: "https://apod.nasa.gov/apod/image/1708/shadow_big.jpg",
+			URL:          "https://apod.nasa.gov/apod/image/1708/shadow.jpg",
+		}},
+	}
+
+	for _, test := range tests {
+		reader, err := openTestFile(test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var htmlPicture picture
+		err = makePictureFromHTML(reader, &htmlPicture)
+		reader.Close()
+		if err != nil {
+			t.Error(test.file, err)
+			continue
+		}
+		if htmlPicture != test.expected {
+			t.Errorf("%s:\n%v\nis not equal to\n%v", test.file, htmlPicture, test.expected)
+		}
+	}
+}
+
+func TestHTMLMissingField(t *testing.T) {
+	page := `<html><body><center><h1>Astronomy Picture of the Day</h1>
+<a href="image/big.jpg"><img src="image/small.jpg"></a></center>
+<center><b>No Explanation</b></center></body></html>`
+	var p picture
+	err := makePictureFromHTML(strings.NewReader(page), &p)
+	var fieldErr *htmlFieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Field != "explanation" {
+		t.Errorf("Expected explanation field error, got %v", err)
+	}
+	if !errors.Is(err, errFieldNotFound) {
+		t.Errorf("Expected errFieldNotFound, got %v", err)
+	}
+}
+
+func TestVideoFileDetection(t *testing.T) {
+	tests := []struct {
+		url       string
+		video     bool
+		animation bool
+	}{
+		{"https://apod.nasa.gov/apod/image/2309/prominence_sdo.mp4", true, false},
+		{"https://apod.nasa.gov/apod/image/2309/Prominence.MOV?download=1", true, false},
+		{"https://apod.nasa.gov/apod/image/2001/comet.gif", false, true},
+		{"https://www.youtube.com/embed/hgzGET6owYk?rel=0", false, false},
+		{"https://apod.nasa.gov/apod/image/2001/ic410_WISEantonucci_960.jpg", false, false},
+	}
+	for _, test := range tests {
+		if isVideoFile(test.url) != test.video {
+			t.Errorf("isVideoFile(%s) should be %v", test.url, test.video)
+		}
+		if isAnimationFile(test.url) != test.animation {
+			t.Errorf("isAnimationFile(%s) should be %v", test.url, test.animation)
+		}
+	}
+
+	var p picture
+	err := makePictureFromAPI(strings.NewReader(`{"media_type":"other","url":"https://apod.nasa.gov/apod/image/2309/prominence_sdo.mp4"}`), &p)
+	if err != nil {
+		t.Error(err)
+	}
+	if p.MediaType != mediaTypeVideo {
+		t.Errorf("Self-hosted video should have %s media type, got %s", mediaTypeVideo, p.MediaType)
+	}
+}
+
+func TestValidatePicture(t *testing.T) {
+	valid := postedPicture()
+	if err := valid.Validate(); err != nil || valid != postedPicture() {
+		t.Errorf("Valid picture shouldn't change, got %v (%v)", valid, err)
+	}
+
+	tests := []struct {
+		field  string
+		modify func(p *picture)
+	}{
+		{"date", func(p *picture) { p.Date = "" }},
+		{"title", func(p *picture) { p.Title = "" }},
+		{"explanation", func(p *picture) { p.Explanation = "" }},
+		{"media_type", func(p *picture) { p.MediaType = "interactive" }},
+		{"url", func(p *picture) { p.URL = "" }},
+		{"url", func(p *picture) { p.URL = "image/2001/ic410_WISEantonucci_960.jpg" }},
+	}
+	for _, test := range tests {
+		p := postedPicture()
+		test.modify(&p)
+		err := p.Validate()
+		var fieldErr *pictureFieldError
+		if !errors.As(err, &fieldErr) || fieldErr.Field != test.field || !errors.Is(err, errInvalidPicture) {
+			t.Errorf("Expected invalid %s, got %v", test.field, err)
+		}
+	}
+
+	// Broken optional URLs are dropped
+	p := postedPicture()
+	p.FullImageURL = "javascript:alert(1)"
+	p.ThumbnailURL = "/thumbnail.jpg"
+	err := p.Validate()
+	if err != nil || len(p.FullImageURL) > 0 || len(p.ThumbnailURL) > 0 {
+		t.Errorf("Expected optional URLs to be dropped, got %v (%v)", p, err)
+	}
+
+	// Interactive content is posted as a link to APOD page
+	p = postedPicture()
+	p.MediaType, p.URL, p.FullImageURL = mediaTypeOther, "", ""
+	err = p.Validate()
+	if err != nil || len(previewURL(p)) > 0 {
+		t.Errorf("Expected other media without preview, got %v (%v)", p, err)
+	}
+	p.ThumbnailURL = "https://apod.nasa.gov/apod/image/0308/marsrotates.jpg"
+	if preview := previewURL(p); preview != p.ThumbnailURL {
+		t.Errorf("Expected thumbnail preview, got %q", preview)
+	}
+}
+
+func TestMessageIDs(t *testing.T) {
+	var tgMessage tgSentMessage
+	apiErr := decodeTGResponse(&http.Response{StatusCode: http.StatusOK}, []byte(`{"ok":true,"result":{"message_id":1234,"chat":{"id":-100}}}`), &tgMessage)
+	if apiErr != nil || tgMessageID(tgMessage) != "1234" {
+		t.Errorf("Unexpected TG message %v (%v)", tgMessage, apiErr)
+	}
+	var ttMessage ttSentMessage
+	err := json.Unmarshal([]byte(`{"message":{"recipient":{"chat_id":1},"body":{"mid":"mid.0000abc","seq":1}}}`), &ttMessage)
+	if err != nil || ttMessage.Message.Body.MID != "mid.0000abc" {
+		t.Errorf("Unexpected TT message %v (%v)", ttMessage, err)
+	}
+}
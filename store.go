@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	storageJSON = "json"
+	storageBolt = "bolt"
+)
+
+// stateStore keeps sent dates and delivery history
+type stateStore interface {
+	View(fn func(tx stateTx) error) error
+	Update(fn func(tx stateTx) error) error
+	Close() error
+}
+
+// stateTx is a store transaction, changes are discarded if Update callback fails
+type stateTx interface {
+	Services() ([]string, error)
+	LastSentDate(service string) (string, error)
+	SetLastSentDate(service string, date string) error
+	AddDelivery(delivery Delivery) error
+	Deliveries(service string) ([]Delivery, error)
+	UpdateDelivery(delivery Delivery) error
+	DeleteDelivery(service string, id int64) error
+	// Translation returns an empty translation if it isn't cached
+	Translation(service string, date string, language string) (Translation, error)
+	SetTranslation(service string, date string, language string, translation Translation) error
+	// Translations returns all cached translations keyed by translationKey
+	Translations(service string) (map[string]Translation, error)
+}
+
+// openStore opens configured storage, JSON state is imported into a new database,
+// dry run uses openDryRunStore instead
+func openStore(storage string) (stateStore, error) {
+	switch storage {
+	case storageJSON:
+		return jsonStore{}, nil
+	case storageBolt:
+		return openBoltStoreWithMigration(boltFilePath(), configFilePath())
+	}
+	return nil, fmt.Errorf("Unknown storage: %s", storage)
+}
+
+func boltFilePath() string {
+	return filepath.Join(filepath.Dir(configFilePath()), boltFile)
+}
+
+// openBoltStoreWithMigration imports JSON state into a new database once
+// and renames the JSON file, so it isn't imported again.
+// JSON state left next to a database with state is ignored
+func openBoltStoreWithMigration(boltPath string, jsonPath string) (stateStore, error) {
+	store, err := openBoltStore(boltPath)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = os.Stat(jsonPath)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+
+	empty, err := isEmptyStore(store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	if !empty {
+		logWarning("Ignoring", jsonPath, "database", boltPath, "already has state")
+		return store, nil
+	}
+
+	err = migrateStore(jsonStore{}, store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	err = os.Rename(jsonPath, jsonPath+".migrated")
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	fmt.Println("State migrated from", jsonPath, "to", boltPath)
+	return store, nil
+}
+
+func isEmptyStore(store stateStore) (bool, error) {
+	var services []string
+	err := store.View(func(tx stateTx) error {
+		var err error
+		services, err = tx.Services()
+		return err
+	})
+	return len(services) == 0, err
+}
+
+// migrateStore copies sent dates, deliveries and cached translations
+func migrateStore(from stateStore, to stateStore) error {
+	return from.View(func(src stateTx) error {
+		return to.Update(func(dst stateTx) error {
+			services, err := src.Services()
+			if err != nil {
+				return err
+			}
+			for _, service := range services {
+				date, err := src.LastSentDate(service)
+				if err != nil {
+					return err
+				}
+				err = dst.SetLastSentDate(service, date)
+				if err != nil {
+					return err
+				}
+				deliveries, err := src.Deliveries(service)
+				if err != nil {
+					return err
+				}
+				for _, delivery := range deliveries {
+					err = dst.AddDelivery(delivery)
+					if err != nil {
+						return err
+					}
+				}
+				translations, err := src.Translations(service)
+				if err != nil {
+					return err
+				}
+				for key, translation := range translations {
+					date, language, _ := strings.Cut(key, "/")
+					err = dst.SetTranslation(service, date, language, translation)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+	})
+}
+
+func readLastSentDate(store stateStore, service string) (string, error) {
+	var date string
+	err := store.View(func(tx stateTx) error {
+		var err error
+		date, err = tx.LastSentDate(service)
+		return err
+	})
+	return date, err
+}
+
+func saveCurrentDate(store stateStore, service string, dateString string) error {
+	return store.Update(func(tx stateTx) error {
+		return tx.SetLastSentDate(service, dateString)
+	})
+}
+
+// saveDelivery records delivery and marks its date as sent
+func saveDelivery(store stateStore, delivery Delivery) error {
+	return store.Update(func(tx stateTx) error {
+		err := tx.AddDelivery(delivery)
+		if err != nil {
+			return err
+		}
+		return tx.SetLastSentDate(delivery.Service, delivery.Date)
+	})
+}
@@ -1,222 +1,277 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"mime/multipart"
-	"net/http"
 	"path"
-	"time"
 )
 
-const (
-	ttUploadTemplate        = "https://botapi.tamtam.chat/uploads?access_token=%s&type=%s"
-	ttSendMessageTemplate   = "https://botapi.tamtam.chat/messages?access_token=%s&chat_id=%d"
-	ttMaxMessageSendRetries = 10
-	ttMessageSendRetryDelay = 2
-	ttFileAttachmentType    = "file"
-	ttImageAttachmentType   = "image"
-)
-
-type ttMessage struct {
-	Text        string                `json:"text"`
-	Attachments []ttMessageAttachment `json:"attachments"`
-	Notify      bool                  `json:"notify"`
-}
-
-type ttMessageAttachment struct {
-	Type    string              `json:"type"`
-	Payload ttAttachmentPayload `json:"payload"`
-}
-
-type ttAttachmentPayload struct {
-	Token string `json:"token"`
-}
-
-func createUploadURL(attachmentType string, token string) (string, error) {
-	url := fmt.Sprintf(ttUploadTemplate, token, attachmentType)
-	req, err := http.Post(url, "application/json", nil)
+// uploadAttachment uploads remote file, shrinking oversized images, and returns attachment token
+func uploadAttachment(client ttClient, remoteURL string, attachmentType string) (string, error) {
+	endpoint, err := client.CreateUpload(attachmentType)
 	if err != nil {
 		return "", err
 	}
-	defer req.Body.Close()
 
-	body, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		return "", err
-	}
-	fmt.Println("TT: Get upload URL response body:", string(body))
-
-	var response struct {
-		URL string `json:"url"`
-	}
-	err = json.Unmarshal(body, &response)
-	if err != nil {
-		return "", err
-	}
-
-	return response.URL, nil
-}
-
-func uploadFile(sourceURL string, destinationURL string, isImage bool) (string, error) {
-	resp, err := http.Get(sourceURL)
+	resp, err := httpGet(remoteURL)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
-
-	_, filename := path.Split(sourceURL)
-
-	var b bytes.Buffer
-	w := multipart.NewWriter(&b)
-	fw, err := w.CreateFormFile("data", filename)
+	err = checkResponseStatus(resp)
 	if err != nil {
 		return "", err
 	}
 
-	_, err = io.Copy(fw, resp.Body)
-	w.Close()
-	if err != nil {
-		return "", err
-	}
-
-	uploadResp, err := http.Post(destinationURL, w.FormDataContentType(), &b)
-	if err != nil {
-		return "", err
+	kind := mediaKindImage
+	switch attachmentType {
+	case ttVideoAttachmentType:
+		kind = mediaKindVideo
+	case ttFileAttachmentType:
+		kind = mediaKindDocument
 	}
-
-	defer uploadResp.Body.Close()
-	body, err := ioutil.ReadAll(uploadResp.Body)
-	fmt.Println("TT: Upload attachment response body:", string(body))
-
-	var response interface{}
-	err = json.Unmarshal(body, &response)
+	file, config, err := checkMedia(resp, kind)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("%s: %w", remoteURL, err)
 	}
 
-	if isImage {
-		var response map[string]interface{}
-		err = json.Unmarshal(body, &response)
-		if err != nil {
-			return "", err
-		}
-		photos := response["photos"].(map[string]interface{})
-		for _, value := range photos {
-			values := value.(map[string]interface{})
-			token, prs := values["token"]
-			if prs {
-				return token.(string), nil
-			}
-		}
-	} else {
-		var response struct {
-			Token string `json:"token"`
-		}
-		err = json.Unmarshal(body, &response)
+	_, filename := path.Split(remoteURL)
+	size := resp.ContentLength
+	if attachmentType == ttImageAttachmentType {
+		file, size, filename, err = fitImageBody(file, size, config, filename, ttImageLimits)
 		if err != nil {
 			return "", err
 		}
-		return response.Token, nil
 	}
-	return "", errors.New("Can't extract token from" + string(body))
+	return client.Upload(endpoint, attachmentType, filename, file, size)
 }
 
-func uploadAttachment(remoteURL string, attachmentType string, token string) (string, error) {
-	uploadURL, err := createUploadURL(attachmentType, token)
-	if err != nil {
-		return "", err
-	}
+// ttSendMessage posts message and returns its mid
+func ttSendMessage(client ttClient, chatID int64, message ttMessage) (string, error) {
+	sent, err := client.SendMessage(chatID, message)
+	return sent.Message.Body.MID, err
+}
 
-	uploadToken, err := uploadFile(remoteURL, uploadURL, attachmentType == ttImageAttachmentType)
-	if err != nil {
-		return "", err
-	}
-	return uploadToken, nil
+func ttPictureText(picture picture) string {
+	return renderTemplate(ttTemplates, templatePhoto, picture)
 }
 
-func ttSendMessage(url string, message interface{}, numberOfRetries int) error {
-	json, err := json.Marshal(message)
-	if err != nil {
-		return errors.New("Failed to create message JSON")
-	}
+func ttVideoCaption(picture picture) string {
+	return renderTemplate(ttTemplates, templateVideo, picture)
+}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(json))
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+func ttVideoText(picture picture) string {
+	return renderTemplate(ttTemplates, templateVideoText, picture)
+}
 
-	fmt.Printf("TT: Post message (%d retries) response status: %d\n", numberOfRetries, resp.StatusCode)
+func ttOtherText(picture picture) string {
+	return renderTemplate(ttTemplates, templateOther, picture)
+}
 
-	if resp.StatusCode == http.StatusBadRequest {
-		if numberOfRetries == ttMaxMessageSendRetries {
-			return errors.New("Max send retries exceed")
-		}
-		time.Sleep(ttMessageSendRetryDelay * time.Second)
-		return ttSendMessage(url, message, numberOfRetries+1)
-	}
+func ttDocumentCaption(picture picture) string {
+	return renderTemplate(ttTemplates, templateDocument, picture)
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+func ttSendPicture(picture picture, token string, chat int64) ([]sentMessage, error) {
+	client := newTTClient(token)
+	// Uploads run concurrently, messages are sent in order: preview, then file
+	var imageToken, fileToken string
+	uploads := []func() error{func() error {
+		var err error
+		imageToken, err = uploadAttachment(client, picture.URL, ttImageAttachmentType)
+		if err == nil && len(imageToken) == 0 {
+			err = errors.New("Empty upload image token")
+		}
 		return err
+	}}
+	if len(picture.FullImageURL) > 0 {
+		uploads = append(uploads, func() error {
+			var err error
+			fileToken, err = uploadAttachment(client, picture.FullImageURL, ttFileAttachmentType)
+			if err == nil && len(fileToken) == 0 {
+				err = errors.New("Empty upload file token")
+			}
+			return err
+		})
 	}
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Bad response status: %s (%s)", resp.Status, string(body))
+	err := uploadPool.Run(uploads...)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
-}
-
-func ttSendPicture(picture picture, token string, chat int64) error {
-	fileToken, err := uploadAttachment(picture.FullImageURL, ttFileAttachmentType, token)
+	imageAttachment := ttMessageAttachment{Type: ttImageAttachmentType, Payload: ttAttachmentPayload{imageToken}}
+	messageID, err := ttSendMessage(client, chat, ttMessage{ttPictureText(picture), []ttMessageAttachment{imageAttachment}, true})
 	if err != nil {
-		return err
+		return nil, err
 	}
-
+	messages := []sentMessage{{messageID, messageKindPhoto}}
 	if len(fileToken) == 0 {
-		return errors.New("Empty upload file token")
+		return messages, nil
 	}
 
-	imageToken, err := uploadAttachment(picture.URL, ttImageAttachmentType, token)
+	fileAttachment := ttMessageAttachment{Type: ttFileAttachmentType, Payload: ttAttachmentPayload{fileToken}}
+	messageID, err = ttSendMessage(client, chat, ttMessage{ttDocumentCaption(picture), []ttMessageAttachment{fileAttachment}, false})
 	if err != nil {
-		return err
+		return messages, err
 	}
 
-	if len(imageToken) == 0 {
-		return errors.New("Empty upload image token")
-	}
-
-	imageAttachment := ttMessageAttachment{Type: ttImageAttachmentType, Payload: ttAttachmentPayload{imageToken}}
-	fileAttachment := ttMessageAttachment{Type: ttFileAttachmentType, Payload: ttAttachmentPayload{fileToken}}
-
-	url := fmt.Sprintf(ttSendMessageTemplate, token, chat)
+	return append(messages, sentMessage{messageID, messageKindDocument}), nil
+}
 
-	text := "🌌" + picture.Title + "\n\n" + picture.Explanation + "\n🔗 " + picture.Link
+func ttSendVideo(picture picture, token string, chat int64) ([]sentMessage, error) {
+	client := newTTClient(token)
+	if isVideoFile(picture.URL) {
+		fits, err := fitsLimits(picture.URL, ttVideoLimits)
+		if fits {
+			videoToken, err := uploadAttachment(client, picture.URL, ttVideoAttachmentType)
+			if err != nil {
+				return nil, err
+			}
+			if len(videoToken) == 0 {
+				return nil, errors.New("Empty upload video token")
+			}
+			videoAttachment := ttMessageAttachment{Type: ttVideoAttachmentType, Payload: ttAttachmentPayload{videoToken}}
+			messageID, err := ttSendMessage(client, chat, ttMessage{ttPictureText(picture), []ttMessageAttachment{videoAttachment}, true})
+			if err != nil {
+				return nil, err
+			}
+			return []sentMessage{{messageID, messageKindVideo}}, nil
+		}
+		if err != nil {
+			logWarning("Can't get video length for TT", picture.URL, err)
+		} else {
+			logWarning("Video is too big for TT", picture.URL)
+		}
+	}
 
-	err = ttSendMessage(url, ttMessage{text, []ttMessageAttachment{imageAttachment}, true}, 0)
+	attachments := []ttMessageAttachment{}
+	kind := messageKindText
+	thumbnailURL, err := videoThumbnailURL(picture)
+	if err == nil {
+		imageToken, err := uploadAttachment(client, thumbnailURL, ttImageAttachmentType)
+		if err == nil && len(imageToken) > 0 {
+			attachments = append(attachments, ttMessageAttachment{Type: ttImageAttachmentType, Payload: ttAttachmentPayload{imageToken}})
+			kind = messageKindPhoto
+		} else {
+			logWarning("Can't upload video thumbnail", thumbnailURL, err)
+		}
+	} else {
+		logWarning("Can't get video thumbnail", err)
+	}
+	text := ttVideoText(picture)
+	if kind == messageKindPhoto {
+		text = ttVideoCaption(picture)
+	}
+	messageID, err := ttSendMessage(client, chat, ttMessage{text, attachments, true})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return []sentMessage{{messageID, kind}}, nil
+}
 
-	fileCaption := ""
-	if len(picture.Copyright) > 0 {
-		fileCaption = "© " + picture.Copyright
+// ttSendOther posts link to interactive content with its preview if there is one
+func ttSendOther(picture picture, token string, chat int64) ([]sentMessage, error) {
+	client := newTTClient(token)
+	attachments := []ttMessageAttachment{}
+	kind := messageKindText
+	if preview := previewURL(picture); len(preview) > 0 {
+		imageToken, err := uploadAttachment(client, preview, ttImageAttachmentType)
+		if err == nil && len(imageToken) > 0 {
+			attachments = append(attachments, ttMessageAttachment{Type: ttImageAttachmentType, Payload: ttAttachmentPayload{imageToken}})
+			kind = messageKindPhoto
+		} else {
+			logWarning("TT: Can't upload preview", preview, err)
+		}
 	}
-	err = ttSendMessage(url, ttMessage{fileCaption, []ttMessageAttachment{fileAttachment}, false}, 0)
+	messageID, err := ttSendMessage(client, chat, ttMessage{ttOtherText(picture), attachments, true})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return []sentMessage{{messageID, kind}}, nil
+}
 
+func ttDelete(delivery Delivery, token string) error {
+	client := newTTClient(token)
+	for _, id := range delivery.MessageIDs {
+		fmt.Println("TT: Deleting message", id, "from", delivery.Chat)
+		err := client.DeleteMessage(id)
+		if errors.Is(err, errMessageNotFound) {
+			fmt.Println("Message", id, "has been deleted already")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func ttSendVideo(picture picture, token string, chat int64) error {
-	url := fmt.Sprintf(ttSendMessageTemplate, token, chat)
-	text := "🌌" + picture.Title + "\n\n" + picture.Explanation + "\n🔗 " + picture.URL
-	return ttSendMessage(url, ttMessage{text, []ttMessageAttachment{}, true}, 0)
+// ttUpdate edits posted messages to match the updated picture
+func ttUpdate(delivery Delivery, updated picture, token string) error {
+	client := newTTClient(token)
+	posted := delivery.Picture
+	for i, id := range delivery.MessageIDs {
+		if i >= len(delivery.MessageKinds) {
+			logWarning("TT: Can't update message", id)
+			continue
+		}
+		kind := delivery.MessageKinds[i]
+
+		var message ttEditedMessage
+		var postedText string
+		var attachmentURL, attachmentType string
+		switch kind {
+		case messageKindPhoto, messageKindText:
+			if updated.MediaType == mediaTypeVideo {
+				message.Text, postedText = ttVideoText(updated), ttVideoText(posted)
+				if kind == messageKindPhoto {
+					message.Text, postedText = ttVideoCaption(updated), ttVideoCaption(posted)
+				}
+				if updated.URL != posted.URL && kind == messageKindPhoto {
+					thumbnailURL, err := videoThumbnailURL(updated)
+					if err != nil {
+						return err
+					}
+					attachmentURL, attachmentType = thumbnailURL, ttImageAttachmentType
+				}
+			} else if updated.MediaType == mediaTypeOther {
+				message.Text, postedText = ttOtherText(updated), ttOtherText(posted)
+				if preview := previewURL(updated); kind == messageKindPhoto && len(preview) > 0 && preview != previewURL(posted) {
+					attachmentURL, attachmentType = preview, ttImageAttachmentType
+				}
+			} else {
+				message.Text, postedText = ttPictureText(updated), ttPictureText(posted)
+				if updated.URL != posted.URL {
+					attachmentURL, attachmentType = updated.URL, ttImageAttachmentType
+				}
+			}
+		case messageKindVideo:
+			message.Text, postedText = ttPictureText(updated), ttPictureText(posted)
+			if updated.URL != posted.URL {
+				attachmentURL, attachmentType = updated.URL, ttVideoAttachmentType
+			}
+		case messageKindDocument:
+			message.Text, postedText = ttDocumentCaption(updated), ttDocumentCaption(posted)
+			if updated.FullImageURL != posted.FullImageURL {
+				attachmentURL, attachmentType = updated.FullImageURL, ttFileAttachmentType
+			}
+		}
+		if len(attachmentURL) == 0 && message.Text == postedText {
+			continue
+		}
+
+		if len(attachmentURL) > 0 {
+			attachmentToken, err := uploadAttachment(client, attachmentURL, attachmentType)
+			if err != nil {
+				return err
+			}
+			message.Attachments = []ttMessageAttachment{{Type: attachmentType, Payload: ttAttachmentPayload{attachmentToken}}}
+		}
+		fmt.Println("TT: Updating", kind, "message", id)
+		err := client.EditMessage(id, message)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	ttAPIURL                = "https://botapi.tamtam.chat"
+	ttMaxMessageSendRetries = 10
+	ttMessageSendRetryDelay = 2
+	ttAttachmentNotReady    = "attachment.not.ready"
+	ttTooManyRequests       = "too.many.requests"
+	ttNotFound              = "not.found"
+	ttFileAttachmentType    = "file"
+	ttImageAttachmentType   = "image"
+	ttVideoAttachmentType   = "video"
+	// Bigger uploads are rejected, video is posted as a link then
+	ttMaxVideoLength = 2 * 1024 * 1024 * 1024
+)
+
+// ttClient calls TamTam Bot API, https://dev.tamtam.chat
+type ttClient struct {
+	BaseURL string
+	Token   string
+}
+
+// ttBaseURL can point to another TamTam compatible API or a test fake
+var ttBaseURL = ttAPIURL
+
+func newTTClient(token string) ttClient {
+	return ttClient{ttBaseURL, token}
+}
+
+type ttMessage struct {
+	Text        string                `json:"text"`
+	Attachments []ttMessageAttachment `json:"attachments"`
+	Notify      bool                  `json:"notify"`
+}
+
+// ttEditedMessage keeps attachments unchanged when they are omitted
+type ttEditedMessage struct {
+	Text        string                `json:"text"`
+	Attachments []ttMessageAttachment `json:"attachments,omitempty"`
+}
+
+type ttMessageAttachment struct {
+	Type    string              `json:"type"`
+	Payload ttAttachmentPayload `json:"payload"`
+}
+
+type ttAttachmentPayload struct {
+	Token string `json:"token"`
+}
+
+// ttUploadEndpoint is where to upload a file, video and audio tokens come with it
+type ttUploadEndpoint struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+// ttUploadedInfo is the upload response, images have a token per resolution
+type ttUploadedInfo struct {
+	Token  string `json:"token"`
+	Photos map[string]struct {
+		Token string `json:"token"`
+	} `json:"photos"`
+}
+
+type ttSentMessage struct {
+	Message struct {
+		Body struct {
+			MID string `json:"mid"`
+		} `json:"body"`
+	} `json:"message"`
+}
+
+// ttSimpleResult is the response of edit and delete methods
+type ttSimpleResult struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// ttError is unsuccessful API response
+type ttError struct {
+	Status  string
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ttError) Error() string {
+	return fmt.Sprintf("Bad response status: %s %s (%s)", e.Status, e.Code, e.Message)
+}
+
+// temporary errors go away if request is sent later
+func (e *ttError) temporary() bool {
+	return e.Code == ttAttachmentNotReady || e.Code == ttTooManyRequests
+}
+
+func (c ttClient) url(path string, query url.Values) string {
+	query.Set("access_token", c.Token)
+	return c.BaseURL + path + "?" + query.Encode()
+}
+
+// CreateUpload returns an endpoint to upload the attachment type to
+func (c ttClient) CreateUpload(attachmentType string) (ttUploadEndpoint, error) {
+	var endpoint ttUploadEndpoint
+	err := c.call(http.MethodPost, c.url("/uploads", url.Values{"type": {attachmentType}}), nil, &endpoint)
+	if err == nil && len(endpoint.URL) == 0 {
+		err = errors.New("Empty upload URL")
+	}
+	return endpoint, err
+}
+
+// Upload streams file to the endpoint and returns attachment token,
+// size is -1 if unknown
+func (c ttClient) Upload(endpoint ttUploadEndpoint, attachmentType string, filename string, file io.Reader, size int64) (string, error) {
+	form, contentType, length, err := multipartBody(nil, "data", filename, file, size)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpPostLength(endpoint.URL, contentType, form, length)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	fmt.Println("TT: Upload attachment response:", resp.StatusCode, string(body))
+	if resp.StatusCode != http.StatusOK {
+		return "", parseTTError(resp, body)
+	}
+
+	// Video token comes with upload endpoint, response body isn't JSON
+	if attachmentType == ttVideoAttachmentType {
+		return endpoint.Token, nil
+	}
+	var info ttUploadedInfo
+	err = json.Unmarshal(body, &info)
+	if err != nil {
+		return "", err
+	}
+	if len(info.Token) > 0 {
+		return info.Token, nil
+	}
+	for _, photo := range info.Photos {
+		if len(photo.Token) > 0 {
+			return photo.Token, nil
+		}
+	}
+	return "", errors.New("Can't extract token from " + string(body))
+}
+
+func (c ttClient) SendMessage(chatID int64, message ttMessage) (ttSentMessage, error) {
+	var sent ttSentMessage
+	query := url.Values{"chat_id": {strconv.FormatInt(chatID, 10)}}
+	err := c.call(http.MethodPost, c.url("/messages", query), message, &sent)
+	return sent, err
+}
+
+func (c ttClient) EditMessage(messageID string, message ttEditedMessage) error {
+	var result ttSimpleResult
+	err := c.call(http.MethodPut, c.url("/messages", url.Values{"message_id": {messageID}}), message, &result)
+	return result.check(err)
+}
+
+func (c ttClient) DeleteMessage(messageID string) error {
+	var result ttSimpleResult
+	err := c.call(http.MethodDelete, c.url("/messages", url.Values{"message_id": {messageID}}), nil, &result)
+	err = result.check(err)
+	var apiErr *ttError
+	if (errors.As(err, &apiErr) && apiErr.Code == ttNotFound) || (err != nil && strings.Contains(strings.ToLower(result.Message), "not found")) {
+		return fmt.Errorf("%w: %v", errMessageNotFound, err)
+	}
+	return err
+}
+
+func (r ttSimpleResult) check(err error) error {
+	if err != nil {
+		return err
+	}
+	if !r.Success {
+		return errors.New("Request failed: " + r.Message)
+	}
+	return nil
+}
+
+// call sends request again while attachments are being processed or rate is limited,
+// other errors fail immediately
+func (c ttClient) call(method string, url string, params interface{}, result interface{}) error {
+	var body []byte
+	if params != nil {
+		var err error
+		body, err = json.Marshal(params)
+		if err != nil {
+			return err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		req, err := newRequest(method, url, reader)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("TT: %s %s response: %d %s\n", method, req.URL.Path, resp.StatusCode, string(respBody))
+		if resp.StatusCode == http.StatusOK {
+			err = json.Unmarshal(respBody, result)
+			if err != nil {
+				return fmt.Errorf("Unexpected response %s: %w", string(respBody), err)
+			}
+			return nil
+		}
+
+		apiErr := parseTTError(resp, respBody)
+		if !apiErr.temporary() || attempt == ttMaxMessageSendRetries {
+			return apiErr
+		}
+		err = sleepContext(ttMessageSendRetryDelay * retryAfterUnit)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func parseTTError(resp *http.Response, body []byte) *ttError {
+	apiErr := ttError{Status: resp.Status}
+	if json.Unmarshal(body, &apiErr) != nil || len(apiErr.Code) == 0 {
+		apiErr.Message = string(body)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		apiErr.Code = ttTooManyRequests
+	}
+	return &apiErr
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTTClient(t *testing.T) {
+	standIn := newAPIStandIn(t,
+		scriptedResponse{http.StatusOK, `{"url":"UPLOAD_URL"}`},
+		scriptedResponse{http.StatusOK, `{"photos":{"960x640":{"token":"image-token"}}}`},
+		scriptedResponse{http.StatusOK, `{"message":{"body":{"mid":"mid.1"}}}`},
+		scriptedResponse{http.StatusOK, `{"success":true}`},
+		scriptedResponse{http.StatusOK, `{"success":false,"message":"Message not found"}`},
+	)
+	client := ttClient{standIn.URL, "token"}
+
+	endpoint, err := client.CreateUpload(ttImageAttachmentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if standIn.calls[0].Path != "/uploads?access_token=token&type=image" || endpoint.URL != "UPLOAD_URL" {
+		t.Errorf("Unexpected upload endpoint %v", standIn.calls[0])
+	}
+
+	endpoint.URL = standIn.URL + "/upload"
+	token, err := client.Upload(endpoint, ttImageAttachmentType, "image.jpg", strings.NewReader("image"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := standIn.calls[1]
+	if token != "image-token" || !strings.Contains(upload.Body, `name="data"; filename="image.jpg"`) || upload.ContentLength != int64(len(upload.Body)) {
+		t.Errorf("Unexpected upload %s %v", token, upload)
+	}
+
+	mid, err := ttSendMessage(client, 42, ttMessage{"text", nil, true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mid != "mid.1" || standIn.calls[2].Path != "/messages?access_token=token&chat_id=42" {
+		t.Errorf("Unexpected message %s %v", mid, standIn.calls[2])
+	}
+
+	err = client.EditMessage("mid.1", ttEditedMessage{Text: "edited"})
+	if err != nil || standIn.calls[3].Body != `{"text":"edited"}` {
+		t.Errorf("Unexpected edit %v (%v)", standIn.calls[3], err)
+	}
+	err = client.DeleteMessage("mid.1")
+	if !errors.Is(err, errMessageNotFound) || !strings.HasSuffix(err.Error(), "Request failed: Message not found") {
+		t.Errorf("Expected unsuccessful result, got %v", err)
+	}
+}
+
+func TestTTUnexpectedUpload(t *testing.T) {
+	for _, body := range []string{`{"photos":"broken"}`, `{"photos":{}}`, `[]`, `not json`} {
+		standIn := newAPIStandIn(t, scriptedResponse{http.StatusOK, body})
+		client := ttClient{standIn.URL, "token"}
+		_, err := client.Upload(ttUploadEndpoint{URL: standIn.URL}, ttImageAttachmentType, "image.jpg", strings.NewReader("image"), 5)
+		if err == nil {
+			t.Errorf("Expected error for %s", body)
+		}
+	}
+
+	standIn := newAPIStandIn(t, scriptedResponse{http.StatusOK, `<retval>1</retval>`})
+	client := ttClient{standIn.URL, "token"}
+	token, err := client.Upload(ttUploadEndpoint{standIn.URL, "video-token"}, ttVideoAttachmentType, "video.mp4", strings.NewReader("video"), -1)
+	if err != nil || token != "video-token" {
+		t.Errorf("Expected token of upload endpoint, got %s (%v)", token, err)
+	}
+}
+
+func TestTTAttachmentNotReady(t *testing.T) {
+	standIn := newAPIStandIn(t,
+		scriptedResponse{http.StatusBadRequest, `{"code":"attachment.not.ready","message":"Key: errors.process.attachment.file.not.processed"}`},
+		scriptedResponse{http.StatusTooManyRequests, `{"code":"too.many.requests","message":"Too many requests"}`},
+		scriptedResponse{http.StatusOK, `{"message":{"body":{"mid":"mid.1"}}}`},
+	)
+	mid, err := ttSendMessage(ttClient{standIn.URL, "token"}, 42, ttMessage{"text", nil, true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mid != "mid.1" || len(standIn.calls) != 3 {
+		t.Errorf("Expected message to be sent again, got %s after %d requests", mid, len(standIn.calls))
+	}
+}
+
+func TestTTErrors(t *testing.T) {
+	standIn := newAPIStandIn(t,
+		scriptedResponse{http.StatusBadRequest, `{"code":"proto.payload","message":"text: size must be between 0 and 4000"}`},
+	)
+	_, err := ttSendMessage(ttClient{standIn.URL, "token"}, 42, ttMessage{"text", nil, true})
+	if err == nil || len(standIn.calls) != 1 {
+		t.Fatalf("Expected validation error to fail at once, got %v after %d requests", err, len(standIn.calls))
+	}
+	if err.Error() != "Bad response status: 400 Bad Request proto.payload (text: size must be between 0 and 4000)" {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	standIn = newAPIStandIn(t,
+		scriptedResponse{http.StatusBadRequest, `{"code":"attachment.not.ready","message":"Key: errors.process.attachment.file.not.processed"}`},
+	)
+	_, err = ttSendMessage(ttClient{standIn.URL, "token"}, 42, ttMessage{"text", nil, true})
+	if err == nil || len(standIn.calls) != ttMaxMessageSendRetries+1 {
+		t.Errorf("Expected %d attempts, got %d", ttMaxMessageSendRetries+1, len(standIn.calls))
+	}
+}
+
+func TestTTSendPicture(t *testing.T) {
+	// Every API method finds its fields in the same response
+	transport := recordRequests(t, `{"url":"https://upload.example.com/","token":"token","message":{"body":{"mid":"mid.1"}}}`)
+	transport.media = noiseImage(64, 48)
+
+	messages, err := ttSendPicture(postedPicture(), "token", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].Kind != messageKindPhoto || messages[1].Kind != messageKindDocument {
+		t.Fatalf("Unexpected messages %v", messages)
+	}
+
+	var attachments []string
+	for _, request := range transport.requests {
+		if !strings.Contains(request.URL, "/messages?") {
+			continue
+		}
+		for _, attachment := range request.Body["attachments"].([]interface{}) {
+			attachments = append(attachments, attachment.(map[string]interface{})["type"].(string))
+		}
+	}
+	if strings.Join(attachments, ",") != "image,file" {
+		t.Errorf("Preview should be sent before file, got %v", attachments)
+	}
+}
+
+func TestTTSendPreviewOnly(t *testing.T) {
+	transport := recordRequests(t, `{"url":"https://upload.example.com/","token":"token","message":{"body":{"mid":"mid.1"}}}`)
+	transport.media = noiseImage(64, 48)
+
+	p := postedPicture()
+	p.FullImageURL = ""
+	messages, err := ttSendPicture(p, "token", 42)
+	if err != nil || len(messages) != 1 || messages[0].Kind != messageKindPhoto {
+		t.Errorf("Expected only preview, got %v (%v)", messages, err)
+	}
+	for _, request := range transport.requests {
+		if strings.Contains(request.URL, "type=file") {
+			t.Error("Unexpected file upload", request.URL)
+		}
+	}
+}
+
+func TestTTUploadInvalidMedia(t *testing.T) {
+	transport := recordRequests(t, `{"url":"https://upload.example.com/","token":"token"}`)
+	transport.media = []byte("<html><body>404 Not Found</body></html>")
+
+	_, err := uploadAttachment(newTTClient("token"), postedPicture().URL, ttImageAttachmentType)
+	if !errors.Is(err, errInvalidMedia) {
+		t.Errorf("Expected invalid media error, got %v", err)
+	}
+	for _, request := range transport.requests {
+		if strings.HasPrefix(request.URL, "https://upload.example.com/") {
+			t.Error("Error page shouldn't be uploaded")
+		}
+	}
+}
+
+func TestTTUploadDocument(t *testing.T) {
+	transport := recordRequests(t, `{"url":"https://upload.example.com/","token":"token"}`)
+	transport.media = []byte("II*\x00\x08\x00\x00\x00")
+
+	token, err := uploadAttachment(newTTClient("token"), "https://apod.nasa.gov/apod/image/2001/ic410.tif", ttFileAttachmentType)
+	if err != nil || token != "token" {
+		t.Errorf("TIFF file should be uploaded as is, got %q (%v)", token, err)
+	}
+}
+
+func TestTTUploadFitsDimensions(t *testing.T) {
+	transport := recordRequests(t, `{"url":"https://upload.example.com/","token":"token"}`)
+	transport.media = noiseImage(64, 48)
+	defaultLimits := ttImageLimits
+	ttImageLimits = mediaLimits{MaxLength: 1024 * 1024, MaxDimension: 32}
+	defer func() { ttImageLimits = defaultLimits }()
+
+	_, err := uploadAttachment(newTTClient("token"), postedPicture().URL, ttImageAttachmentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := transport.requests[len(transport.requests)-1]
+	_, file, _ := strings.Cut(upload.RawBody, "\r\n\r\n")
+	config, _, err := image.DecodeConfig(strings.NewReader(file))
+	if err != nil || config.Width != 32 || config.Height != 24 {
+		t.Errorf("Expected image resized to 32x24, got %dx%d (%v)", config.Width, config.Height, err)
+	}
+}
+
+func TestTTSendVideoTooBig(t *testing.T) {
+	transport := recordRequests(t, `{"url":"https://upload.example.com/","token":"token","message":{"body":{"mid":"mid.1"}}}`)
+	transport.media = []byte("\x00\x00\x00\x18ftypmp42")
+	defaultLimits := ttVideoLimits
+	ttVideoLimits = mediaLimits{MaxLength: 8}
+	defer func() { ttVideoLimits = defaultLimits }()
+
+	p := postedPicture()
+	p.MediaType = mediaTypeVideo
+	p.URL = "https://apod.nasa.gov/apod/image/2001/tadpole.mp4"
+	p.FullImageURL = ""
+	messages, err := ttSendVideo(p, "token", 42)
+	if err != nil || len(messages) != 1 || messages[0].Kind != messageKindText {
+		t.Fatalf("Expected video text, got %v (%v)", messages, err)
+	}
+	for _, request := range transport.requests {
+		if strings.Contains(request.URL, "/uploads") {
+			t.Error("Unexpected video upload", request.URL)
+		}
+	}
+
+	ttVideoLimits = defaultLimits
+	messages, err = ttSendVideo(p, "token", 42)
+	if err != nil || len(messages) != 1 || messages[0].Kind != messageKindVideo {
+		t.Errorf("Expected video, got %v (%v)", messages, err)
+	}
+}
@@ -1,45 +1,25 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"mime/multipart"
-	"net/http"
 	"path"
 	"strconv"
 	"strings"
 )
 
 const (
-	tgSendMessageTemplate = "https://api.telegram.org/bot%s/sendMessage"
-	tgSendPhotoTemplate   = "https://api.telegram.org/bot%s/sendPhoto?parse_mode=Markdown"
-	tgSendFileTemplate    = "https://api.telegram.org/bot%s/sendDocument?parse_mode=Markdown"
-	tgParseModeMarkdown   = "Markdown"
-	tgParseModeHTML       = "HTML"
+	// Bots can currently send files of any type of up to 50 MB in size, this limit may be changed in the future. 🤦‍♂️
+	// https://core.telegram.org/bots/api#senddocument
+	tgMaxFileLength = 50 * 1024 * 1024
+	// Local Bot API server uploads files up to 2000 MB
+	// https://core.telegram.org/bots/api#using-a-local-bot-api-server
+	tgLocalMaxFileLength = 2000 * 1024 * 1024
+	tgParseModeMarkdown  = "Markdown"
+	tgParseModeHTML      = "HTML"
 )
 
-type tgMessage struct {
-	Chat      int64  `json:"chat_id"`
-	Text      string `json:"text"`
-	ParseMode string `json:"parse_mode"`
-}
-
-type tgPhotoMessage struct {
-	Chat     int64  `json:"chat_id"`
-	Text     string `json:"caption"`
-	ImageURL string `json:"photo"`
-}
-
-type tgDocumentMessage struct {
-	Chat    int64  `json:"chat_id"`
-	Text    string `json:"caption"`
-	FileURL string `json:"document"`
-	Silent  bool   `json:"disable_notification"`
-}
-
 func firstSentences(s string, count int) string {
 	for i := range s {
 		c := s[i]
@@ -53,145 +33,333 @@ func firstSentences(s string, count int) string {
 	return s
 }
 
-func fillForm(b *bytes.Buffer, chatID int64, caption string, remoteFileURL string) (string, error) {
-	w := multipart.NewWriter(b)
-	defer w.Close()
-
-	// Fields
-	fw, err := w.CreateFormField("chat_id")
-	if err != nil {
-		return "", err
-	}
-	io.WriteString(fw, strconv.FormatInt(chatID, 10))
+// Even though sending file just by providing remoteURL exists,
+// looks like it is more reliable to use multi-form POST
+func tgSendDocument(client tgClient, chatID int64, caption string, remoteFileURL string) (string, error) {
+	return tgSendFile(client, tgMethodSendDocument, "document", chatID, caption, remoteFileURL, true)
+}
 
-	fw, err = w.CreateFormField("caption")
-	if err != nil {
-		return "", err
+func tgSendFile(client tgClient, method string, fileField string, chatID int64, caption string, remoteFileURL string, silent bool) (string, error) {
+	kind := mediaKindImage
+	switch method {
+	case tgMethodSendVideo:
+		kind = mediaKindVideo
+	case tgMethodSendDocument:
+		kind = mediaKindDocument
 	}
-	io.WriteString(fw, caption)
-
-	fw, err = w.CreateFormField("disable_notification")
-	if err != nil {
-		return "", err
+	media := &remoteMedia{url: remoteFileURL, kind: kind}
+	defer media.Close()
+	open := func() (io.Reader, int64, error) {
+		body, _, length, err := media.open()
+		return body, length, err
 	}
-	io.WriteString(fw, "true")
-
-	// File
-	resp, err := http.Get(remoteFileURL)
+	body, length, err := open()
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
 
 	_, filename := path.Split(remoteFileURL)
+	sent, err := client.SendFile(method, chatID, caption, tgInputFile{fileField, filename, body, length, open}, silent)
+	return tgMessageID(sent), err
+}
 
-	fw, err = w.CreateFormFile("document", filename)
+// tgSendFittedImage uploads image, shrinking it to the limits if needed
+func tgSendFittedImage(client tgClient, method string, fileField string, chatID int64, caption string, remoteFileURL string, limits mediaLimits, silent bool) (string, error) {
+	media := &remoteMedia{url: remoteFileURL, kind: mediaKindImage}
+	defer media.Close()
+	_, filename := path.Split(remoteFileURL)
+	fit := func() (io.Reader, int64, string, error) {
+		body, config, length, err := media.open()
+		if err != nil {
+			return nil, 0, "", err
+		}
+		return fitImageBody(body, length, config, filename, limits)
+	}
+	body, length, fittedFilename, err := fit()
 	if err != nil {
 		return "", err
 	}
+	// Image is fitted the same way again
+	reopen := func() (io.Reader, int64, error) {
+		body, length, _, err := fit()
+		return body, length, err
+	}
+	sent, err := client.SendFile(method, chatID, caption, tgInputFile{fileField, fittedFilename, body, length, reopen}, silent)
+	return tgMessageID(sent), err
+}
 
-	_, err = io.Copy(fw, resp.Body)
+// tgSendPhoto uploads photo downloaded by the bot, shrinking it if needed.
+// Telegram fetching the URL itself is a fallback, it fails for big images
+// and whenever NASA is slow for Telegram
+func tgSendPhoto(client tgClient, chatID int64, caption string, photoURL string) (string, error) {
+	messageID, err := tgSendFittedImage(client, tgMethodSendPhoto, "photo", chatID, caption, photoURL, tgPhotoLimits, false)
+	// Telegram would get the same broken media by URL
+	if err == nil || tgMigratedChat(err) != 0 || errors.Is(err, errInvalidMedia) || httpContext.Err() != nil {
+		return messageID, err
+	}
+	logWarning("TG: Can't upload photo, sending URL", photoURL, err)
 
-	if err != nil {
-		return "", err
+	sent, urlErr := client.SendPhoto(tgPhotoMessage{chatID, caption, photoURL, tgParseModeMarkdown})
+	if urlErr != nil {
+		return "", fmt.Errorf("%w, URL fallback failed too: %w", err, urlErr)
 	}
+	return tgMessageID(sent), nil
+}
 
-	return w.FormDataContentType(), nil
+func tgMessageID(message tgSentMessage) string {
+	return strconv.FormatInt(message.MessageID, 10)
 }
 
-// Even though sending file just by providing remoteURL exists,
-// looks like it is more reliable to use multi-form POST
-func tgSendDocument(chatID int64, caption string, remoteFileURL string, token string) error {
-	var b bytes.Buffer
-	ct, err := fillForm(&b, chatID, caption, remoteFileURL)
-	if err != nil {
-		return err
-	}
+func tgPictureCaption(picture picture) string {
+	return renderTemplate(tgTemplates, templatePhoto, picture)
+}
 
-	url := fmt.Sprintf(tgSendFileTemplate, token)
-	resp, err := http.Post(url, ct, &b)
-	if err != nil {
-		return err
-	}
+func tgVideoCaption(picture picture) string {
+	return renderTemplate(tgTemplates, templateVideo, picture)
+}
 
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	fmt.Println("TG: POST document response body:", string(body))
+func tgVideoText(picture picture) string {
+	return renderTemplate(tgTemplates, templateVideoText, picture)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Bad response status: %s (%s)", resp.Status, string(body))
-	}
-	return nil
+func tgOtherText(picture picture) string {
+	return renderTemplate(tgTemplates, templateOther, picture)
 }
 
-func tgSendMessage(message interface{}, urlTemplate string, token string) error {
-	json, err := json.Marshal(message)
+func tgDocumentCaption(picture picture) string {
+	return renderTemplate(tgTemplates, templateDocument, picture)
+}
+
+func tgSendPicture(picture picture, token string, chat int64) ([]sentMessage, error) {
+	client := newTGClient(token)
+	photoCaption := tgPictureCaption(picture)
+
+	message := sentMessage{Kind: messageKindPhoto}
+	var err error
+	if isAnimationFile(picture.URL) && fitsAnimation(picture.URL) {
+		// sendPhoto shows only the first frame of GIFs
+		message.Kind = messageKindAnimation
+		message.ID, err = tgSendFile(client, tgMethodSendAnimation, "animation", chat, photoCaption, picture.URL, false)
+	} else {
+		message.ID, err = tgSendPhoto(client, chat, photoCaption, picture.URL)
+	}
 	if err != nil {
-		return err
+		return nil, err
+	}
+	messages := []sentMessage{message}
+	if len(picture.FullImageURL) == 0 {
+		return messages, nil
 	}
 
-	url := fmt.Sprintf(urlTemplate, token)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(json))
+	documentCaption := tgDocumentCaption(picture)
+	document := sentMessage{Kind: messageKindDocument}
+	fullImageURL := picture.FullImageURL
+	fits, lengthErr := fitsTG(fullImageURL)
+	switch {
+	case fits:
+		document.ID, err = tgSendDocument(client, chat, documentCaption, fullImageURL)
+	case isResizableImage(fullImageURL):
+		if lengthErr != nil {
+			fmt.Println("TG: Can't get picture length, checking it while uploading", fullImageURL, lengthErr)
+		} else {
+			fmt.Println("TG: Picture is too big, resizing", fullImageURL)
+		}
+		document.ID, err = tgSendFittedImage(client, tgMethodSendDocument, "document", chat, documentCaption, fullImageURL, tgDocumentLimits, true)
+	case lengthErr != nil:
+		// Telegram rejects it if it turns out to be too big
+		fmt.Println("TG: Can't get file length, sending as is", fullImageURL, lengthErr)
+		document.ID, err = tgSendDocument(client, chat, documentCaption, fullImageURL)
+	default:
+		logWarning("Full image is too big for TG and can't be resized", fullImageURL)
+		return messages, nil
+	}
 	if err != nil {
-		return err
+		return messages, err
 	}
-	defer resp.Body.Close()
+	return append(messages, document), nil
+}
 
-	fmt.Println("TG: Post message response status:", resp.StatusCode)
-	body, err := ioutil.ReadAll(resp.Body)
+func tgSendVideo(picture picture, token string, chat int64) ([]sentMessage, error) {
+	client := newTGClient(token)
+	if isVideoFile(picture.URL) {
+		fits, err := fitsTG(picture.URL)
+		if fits {
+			caption := tgPictureCaption(picture)
+			messageID, err := tgSendFile(client, tgMethodSendVideo, "video", chat, caption, picture.URL, false)
+			if err != nil {
+				return nil, err
+			}
+			return []sentMessage{{messageID, messageKindVideo}}, nil
+		}
+		if err != nil {
+			logWarning("Can't get video length for TG", picture.URL, err)
+		} else {
+			logWarning("Video is too big for TG", picture.URL)
+		}
+	} else {
+		thumbnailURL, err := videoThumbnailURL(picture)
+		if err == nil {
+			messageID, err := tgSendPhoto(client, chat, tgVideoCaption(picture), thumbnailURL)
+			if err != nil {
+				return nil, err
+			}
+			return []sentMessage{{messageID, messageKindPhoto}}, nil
+		}
+		logWarning("Can't get video thumbnail", err)
+	}
+	sent, err := client.SendMessage(tgMessage{chat, tgVideoText(picture), tgParseModeMarkdown})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return []sentMessage{{tgMessageID(sent), messageKindText}}, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Bad response status: %s (%s)", resp.Status, string(body))
+// tgSendOther posts link to interactive content with its preview if there is one
+func tgSendOther(picture picture, token string, chat int64) ([]sentMessage, error) {
+	client := newTGClient(token)
+	text := tgOtherText(picture)
+	if preview := previewURL(picture); len(preview) > 0 {
+		messageID, err := tgSendPhoto(client, chat, text, preview)
+		if err == nil || tgMigratedChat(err) != 0 {
+			return []sentMessage{{messageID, messageKindPhoto}}, err
+		}
+		logWarning("TG: Can't send preview", preview, err)
+	}
+	sent, err := client.SendMessage(tgMessage{chat, text, tgParseModeMarkdown})
+	if err != nil {
+		return nil, err
 	}
-	fmt.Println("TG: Post message response body:", string(body))
+	return []sentMessage{{tgMessageID(sent), messageKindText}}, nil
+}
 
+// tgUpdate edits posted messages to match the updated picture
+func tgUpdate(delivery Delivery, updated picture, token string) error {
+	client := newTGClient(token)
+	posted := delivery.Picture
+	for i, id := range delivery.MessageIDs {
+		messageID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil || i >= len(delivery.MessageKinds) {
+			logWarning("TG: Can't update message", id)
+			continue
+		}
+		kind := delivery.MessageKinds[i]
+
+		var message interface{}
+		var method string
+		switch kind {
+		case messageKindPhoto, messageKindAnimation, messageKindVideo:
+			caption, postedCaption := tgPictureCaption(updated), tgPictureCaption(posted)
+			mediaURL := updated.URL
+			mediaChanged := updated.URL != posted.URL
+			if updated.MediaType == mediaTypeVideo && kind == messageKindPhoto {
+				caption, postedCaption = tgVideoCaption(updated), tgVideoCaption(posted)
+				if mediaChanged {
+					mediaURL, err = videoThumbnailURL(updated)
+					if err != nil {
+						return err
+					}
+				}
+			} else if updated.MediaType == mediaTypeOther {
+				caption, postedCaption = tgOtherText(updated), tgOtherText(posted)
+				mediaURL = previewURL(updated)
+				mediaChanged = len(mediaURL) > 0 && mediaURL != previewURL(posted)
+			}
+			if mediaChanged {
+				media := tgInputMedia{kind, mediaURL, caption, tgParseModeMarkdown}
+				message, method = tgEditMediaMessage{delivery.Chat, messageID, media}, tgMethodEditMessageMedia
+			} else if caption != postedCaption {
+				message, method = tgEditCaptionMessage{delivery.Chat, messageID, caption, tgParseModeMarkdown}, tgMethodEditMessageCaption
+			}
+		case messageKindDocument:
+			caption := tgDocumentCaption(updated)
+			// Document stays if hdurl disappeared
+			if updated.FullImageURL != posted.FullImageURL && len(updated.FullImageURL) > 0 {
+				media := tgInputMedia{kind, updated.FullImageURL, caption, tgParseModeMarkdown}
+				message, method = tgEditMediaMessage{delivery.Chat, messageID, media}, tgMethodEditMessageMedia
+			} else if caption != tgDocumentCaption(posted) {
+				message, method = tgEditCaptionMessage{delivery.Chat, messageID, caption, tgParseModeMarkdown}, tgMethodEditMessageCaption
+			}
+		case messageKindText:
+			text, postedText := tgVideoText(updated), tgVideoText(posted)
+			if updated.MediaType == mediaTypeOther {
+				text, postedText = tgOtherText(updated), tgOtherText(posted)
+			}
+			if text != postedText {
+				message, method = tgEditTextMessage{delivery.Chat, messageID, text, tgParseModeMarkdown}, tgMethodEditMessageText
+			}
+		}
+		if message == nil {
+			continue
+		}
+		fmt.Println("TG: Updating", kind, "message", id)
+		err = client.Call(method, message, nil)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func tgSendPicture(picture picture, token string, chat int64) error {
-	explanation := firstSentences(picture.Explanation, 2) // TODO: max 1024
-	photoCaption := "*" + picture.Title + "*\n" + explanation + "…\n" + picture.Link
-
-	// Somehow TG sometimes doesn't like full image URLs (too big?)
-	photo := tgPhotoMessage{chat, photoCaption, picture.URL}
-	err := tgSendMessage(photo, tgSendPhotoTemplate, token)
-	if err != nil {
-		return err
+func tgDelete(delivery Delivery, token string) error {
+	client := newTGClient(token)
+	for _, id := range delivery.MessageIDs {
+		messageID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return err
+		}
+		fmt.Println("TG: Deleting message", id, "from", delivery.Chat)
+		err = client.DeleteMessage(delivery.Chat, messageID)
+		if errors.Is(err, errMessageNotFound) {
+			fmt.Println("Message", id, "has been deleted already")
+			continue
+		}
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Bots can currently send files of any type of up to 50 MB in size, this limit may be changed in the future. 🤦‍♂️
-	// https://core.telegram.org/bots/api#senddocument
-	const maxLength = 50 * 1024 * 1024
-	fullImageURL := picture.FullImageURL
-	length, err := getContentLength(fullImageURL)
-	if length >= maxLength {
-		logWarning("Picture is too big for TG", fullImageURL)
-		return nil
-	}
+// fitsTG checks remote file size against bot upload limit
+func fitsTG(url string) (bool, error) {
+	return fitsLimits(url, tgDocumentLimits)
+}
 
-	documentCaption := ""
-	if len(picture.Copyright) > 0 {
-		documentCaption = "© " + picture.Copyright
+// fitsAnimation tells if animation can be uploaded, it's sent as a photo otherwise
+func fitsAnimation(url string) bool {
+	fits, err := fitsTG(url)
+	if err != nil {
+		logWarning("Can't get animation length for TG", url, err)
+	} else if !fits {
+		fmt.Println("TG: Animation is too big, sending as photo", url)
 	}
-	return tgSendDocument(chat, documentCaption, fullImageURL, token)
+	return fits
 }
 
-func tgSendVideo(picture picture, token string, chat int64) error {
-	text := "[" + picture.Title + "](" + picture.URL + ")\n" + picture.Explanation
-	message := tgMessage{chat, text, tgParseModeMarkdown}
-	return tgSendMessage(message, tgSendMessageTemplate, token)
+// fitsLimits fails if length is unknown, the file has to be downloaded then
+func fitsLimits(url string, limits mediaLimits) (bool, error) {
+	length, err := getContentLength(url)
+	if err != nil {
+		return false, err
+	}
+	return limits.fitsLength(length), nil
 }
 
 func getContentLength(url string) (int64, error) {
-	res, err := http.Head(url)
+	res, err := httpHead(url)
 	if err != nil {
 		return 0, err
 	}
+	defer res.Body.Close()
 
+	err = checkResponseStatus(res)
+	if err != nil {
+		return 0, err
+	}
 	contentlength := res.ContentLength
 	fmt.Println("TG: Full image ContentLength:", contentlength)
+	if contentlength < 0 {
+		return 0, errors.New("Unknown content length")
+	}
 	return contentlength, nil
 }
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	tgAPIURL                   = "https://api.telegram.org"
+	tgMethodSendMessage        = "sendMessage"
+	tgMethodSendPhoto          = "sendPhoto"
+	tgMethodSendDocument       = "sendDocument"
+	tgMethodSendVideo          = "sendVideo"
+	tgMethodSendAnimation      = "sendAnimation"
+	tgMethodEditMessageCaption = "editMessageCaption"
+	tgMethodEditMessageText    = "editMessageText"
+	tgMethodEditMessageMedia   = "editMessageMedia"
+	tgMethodDeleteMessage      = "deleteMessage"
+	tgMaxRetries               = 3
+	tgMaxRetryAfter            = 60 // seconds, longer flood waits fail the run
+)
+
+// tgClient calls Bot API methods, https://core.telegram.org/bots/api
+type tgClient struct {
+	BaseURL string
+	Token   string
+}
+
+// tgBaseURL can point to a local telegram-bot-api server or a test fake
+var tgBaseURL = tgAPIURL
+
+func newTGClient(token string) tgClient {
+	return tgClient{tgBaseURL, token}
+}
+
+type tgMessage struct {
+	Chat      int64  `json:"chat_id"`
+	Text      string `json:"text"`
+	ParseMode string `json:"parse_mode"`
+}
+
+type tgPhotoMessage struct {
+	Chat      int64  `json:"chat_id"`
+	Text      string `json:"caption"`
+	ImageURL  string `json:"photo"`
+	ParseMode string `json:"parse_mode,omitempty"`
+}
+
+type tgEditCaptionMessage struct {
+	Chat      int64  `json:"chat_id"`
+	MessageID int64  `json:"message_id"`
+	Caption   string `json:"caption"`
+	ParseMode string `json:"parse_mode"`
+}
+
+type tgEditTextMessage struct {
+	Chat      int64  `json:"chat_id"`
+	MessageID int64  `json:"message_id"`
+	Text      string `json:"text"`
+	ParseMode string `json:"parse_mode"`
+}
+
+type tgEditMediaMessage struct {
+	Chat      int64        `json:"chat_id"`
+	MessageID int64        `json:"message_id"`
+	Media     tgInputMedia `json:"media"`
+}
+
+type tgDeleteMessage struct {
+	Chat      int64 `json:"chat_id"`
+	MessageID int64 `json:"message_id"`
+}
+
+type tgInputMedia struct {
+	Type      string `json:"type"`
+	Media     string `json:"media"`
+	Caption   string `json:"caption"`
+	ParseMode string `json:"parse_mode"`
+}
+
+// errStreamConsumed means the file has been read by previous attempt
+var errStreamConsumed = errors.New("Streamed file can't be sent again")
+
+// tgInputFile is a file streamed with multipart form
+type tgInputFile struct {
+	Field  string
+	Name   string
+	Reader io.Reader
+	Size   int64 // -1 if unknown
+	// Reopen downloads the file again for another attempt, nil if it can't be
+	Reopen func() (io.Reader, int64, error)
+}
+
+// tgResponse is the envelope of every Bot API response
+type tgResponse struct {
+	OK          bool                 `json:"ok"`
+	Result      json.RawMessage      `json:"result"`
+	ErrorCode   int                  `json:"error_code"`
+	Description string               `json:"description"`
+	Parameters  tgResponseParameters `json:"parameters"`
+}
+
+type tgResponseParameters struct {
+	RetryAfter      int   `json:"retry_after"`
+	MigrateToChatID int64 `json:"migrate_to_chat_id"`
+}
+
+// tgSentMessage is the part of Message the bot needs
+type tgSentMessage struct {
+	MessageID int64 `json:"message_id"`
+	Chat      struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+}
+
+// tgError is unsuccessful Bot API response
+type tgError struct {
+	ErrorCode   int
+	Description string
+	Parameters  tgResponseParameters
+}
+
+func (e *tgError) Error() string {
+	return fmt.Sprintf("Bad response: %d %s", e.ErrorCode, e.Description)
+}
+
+// tgMigratedChat returns the new supergroup id if the group was upgraded
+func tgMigratedChat(err error) int64 {
+	var apiErr *tgError
+	if errors.As(err, &apiErr) {
+		return apiErr.Parameters.MigrateToChatID
+	}
+	return 0
+}
+
+func (c tgClient) SendMessage(message tgMessage) (tgSentMessage, error) {
+	var sent tgSentMessage
+	err := c.Call(tgMethodSendMessage, message, &sent)
+	return sent, err
+}
+
+func (c tgClient) SendPhoto(message tgPhotoMessage) (tgSentMessage, error) {
+	var sent tgSentMessage
+	err := c.Call(tgMethodSendPhoto, message, &sent)
+	return sent, err
+}
+
+// SendFile uploads file with Markdown caption using sendPhoto, sendDocument, sendVideo or sendAnimation
+func (c tgClient) SendFile(method string, chatID int64, caption string, file tgInputFile, silent bool) (tgSentMessage, error) {
+	params := map[string]string{
+		"chat_id":              fmt.Sprint(chatID),
+		"caption":              caption,
+		"parse_mode":           tgParseModeMarkdown,
+		"disable_notification": fmt.Sprint(silent),
+	}
+	var sent tgSentMessage
+	err := c.Upload(method, params, file, &sent)
+	return sent, err
+}
+
+func (c tgClient) DeleteMessage(chatID int64, messageID int64) error {
+	err := c.Call(tgMethodDeleteMessage, tgDeleteMessage{chatID, messageID}, nil)
+	var apiErr *tgError
+	if errors.As(err, &apiErr) && strings.Contains(apiErr.Description, "message to delete not found") {
+		return fmt.Errorf("%w: %v", errMessageNotFound, err)
+	}
+	return err
+}
+
+// Call sends JSON params to the method and decodes its result,
+// result is ignored if it's nil or the method returns just true
+func (c tgClient) Call(method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return c.post(method, func() (io.Reader, string, int64, error) {
+		return bytes.NewReader(body), "application/json", int64(len(body)), nil
+	}, result)
+}
+
+// Upload streams params and file as multipart form,
+// it's sent again only if file can be reopened or its reader can seek
+func (c tgClient) Upload(method string, params map[string]string, file tgInputFile, result interface{}) error {
+	sent := false
+	return c.post(method, func() (io.Reader, string, int64, error) {
+		if sent && file.Reopen != nil {
+			var err error
+			file.Reader, file.Size, err = file.Reopen()
+			if err != nil {
+				return nil, "", 0, err
+			}
+		} else if sent {
+			seeker, ok := file.Reader.(io.Seeker)
+			if !ok {
+				return nil, "", 0, errStreamConsumed
+			}
+			_, err := seeker.Seek(0, io.SeekStart)
+			if err != nil {
+				return nil, "", 0, err
+			}
+		}
+		sent = true
+		return multipartBody(params, file.Field, file.Name, file.Reader, file.Size)
+	}, result)
+}
+
+// post sends request again after retry_after seconds if Telegram asks so,
+// newBody returns request body, its content type and length
+func (c tgClient) post(method string, newBody func() (io.Reader, string, int64, error), result interface{}) error {
+	url := fmt.Sprintf("%s/bot%s/%s", c.BaseURL, c.Token, method)
+	var apiErr *tgError
+	for attempt := 0; ; attempt++ {
+		body, contentType, length, err := newBody()
+		if errors.Is(err, errStreamConsumed) && apiErr != nil {
+			return apiErr
+		}
+		if err != nil {
+			return err
+		}
+		resp, err := httpPostLength(url, contentType, body, length)
+		if err != nil {
+			return err
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("TG: %s response: %d %s\n", method, resp.StatusCode, string(respBody))
+
+		apiErr = decodeTGResponse(resp, respBody, result)
+		if apiErr == nil {
+			return nil
+		}
+		retryAfter := apiErr.Parameters.RetryAfter
+		if retryAfter == 0 || retryAfter > tgMaxRetryAfter || attempt == tgMaxRetries {
+			return apiErr
+		}
+		fmt.Println("TG: Too many requests, retrying after", retryAfter, "seconds")
+		err = sleepContext(time.Duration(retryAfter) * retryAfterUnit)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// decodeTGResponse unpacks result of successful response or returns API error
+func decodeTGResponse(resp *http.Response, body []byte, result interface{}) *tgError {
+	var response tgResponse
+	err := json.Unmarshal(body, &response)
+	if err != nil || (!response.OK && response.ErrorCode == 0) {
+		return &tgError{ErrorCode: resp.StatusCode, Description: string(body)}
+	}
+	if !response.OK {
+		return &tgError{response.ErrorCode, response.Description, response.Parameters}
+	}
+	// Edit and delete methods may return just true
+	if result == nil || string(response.Result) == "true" {
+		return nil
+	}
+	err = json.Unmarshal(response.Result, result)
+	if err != nil {
+		return &tgError{ErrorCode: resp.StatusCode, Description: "Unexpected result " + string(response.Result)}
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTGClient(t *testing.T) {
+	standIn := newAPIStandIn(t, scriptedResponse{http.StatusOK, `{"ok":true,"result":{"message_id":7,"chat":{"id":42}}}`})
+	client := tgClient{standIn.URL, "token"}
+
+	sent, err := client.SendMessage(tgMessage{42, "text", tgParseModeMarkdown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.MessageID != 7 || sent.Chat.ID != 42 {
+		t.Errorf("Unexpected message %v", sent)
+	}
+	call := standIn.calls[0]
+	if call.Path != "/bottoken/sendMessage" || call.ContentType != "application/json" || call.Body != `{"chat_id":42,"text":"text","parse_mode":"Markdown"}` {
+		t.Errorf("Unexpected request %v", call)
+	}
+
+	sent, err = client.SendFile(tgMethodSendDocument, 42, "caption", tgInputFile{"document", "image.jpg", strings.NewReader("image"), 5, nil}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call = standIn.calls[1]
+	if call.Path != "/bottoken/sendDocument" || !strings.HasPrefix(call.ContentType, "multipart/form-data") {
+		t.Errorf("Unexpected request %v", call)
+	}
+	for _, field := range []string{`name="caption"`, `name="parse_mode"`, `name="disable_notification"`, `name="document"; filename="image.jpg"`} {
+		if !strings.Contains(call.Body, field) {
+			t.Errorf("Form doesn't contain %s: %s", field, call.Body)
+		}
+	}
+}
+
+func TestTGUploadStreaming(t *testing.T) {
+	standIn := newAPIStandIn(t,
+		scriptedResponse{http.StatusTooManyRequests, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 1","parameters":{"retry_after":1}}`},
+		scriptedResponse{http.StatusOK, `{"ok":true,"result":{"message_id":7}}`},
+	)
+	client := tgClient{standIn.URL, "token"}
+
+	// Seekable file is sent again with the same length
+	sent, err := client.SendFile(tgMethodSendPhoto, 42, "caption", tgInputFile{"photo", "image.jpg", strings.NewReader("image"), 5, nil}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.MessageID != 7 || len(standIn.calls) != 2 {
+		t.Fatalf("Expected file to be sent again, got %v", standIn.calls)
+	}
+	for _, call := range standIn.calls {
+		if call.ContentLength != int64(len(call.Body)) || !strings.Contains(call.Body, "\r\n\r\nimage\r\n") {
+			t.Errorf("Unexpected Content-Length %d of %q", call.ContentLength, call.Body)
+		}
+	}
+
+	// Stream of unknown size is chunked and can't be sent again
+	standIn = newAPIStandIn(t,
+		scriptedResponse{http.StatusTooManyRequests, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 1","parameters":{"retry_after":1}}`},
+	)
+	client = tgClient{standIn.URL, "token"}
+	stream := ioutil.NopCloser(strings.NewReader("image"))
+	_, err = client.SendFile(tgMethodSendPhoto, 42, "caption", tgInputFile{"photo", "image.jpg", stream, -1, nil}, false)
+	if err == nil || err.Error() != "Bad response: 429 Too Many Requests: retry after 1" || len(standIn.calls) != 1 {
+		t.Errorf("Expected API error after one request, got %v after %v", err, standIn.calls)
+	}
+	if call := standIn.calls[0]; call.ContentLength != -1 || !strings.Contains(call.Body, "image") {
+		t.Errorf("Expected chunked request, got %v", call)
+	}
+
+	// Stream that can be downloaded again is sent after retry_after
+	standIn = newAPIStandIn(t,
+		scriptedResponse{http.StatusTooManyRequests, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 1","parameters":{"retry_after":1}}`},
+		scriptedResponse{http.StatusOK, `{"ok":true,"result":{"message_id":7}}`},
+	)
+	client = tgClient{standIn.URL, "token"}
+	reopened := 0
+	reopen := func() (io.Reader, int64, error) {
+		reopened++
+		return ioutil.NopCloser(strings.NewReader("image")), -1, nil
+	}
+	sent, err = client.SendFile(tgMethodSendDocument, 42, "caption", tgInputFile{"document", "image.jpg", stream, -1, reopen}, true)
+	if err != nil || sent.MessageID != 7 || reopened != 1 || len(standIn.calls) != 2 {
+		t.Fatalf("Expected file to be downloaded and sent again, got %v after %d downloads (%v)", standIn.calls, reopened, err)
+	}
+	if !strings.Contains(standIn.calls[1].Body, "\r\n\r\nimage\r\n") {
+		t.Errorf("Unexpected body of the second request %q", standIn.calls[1].Body)
+	}
+}
+
+func TestTGClientResults(t *testing.T) {
+	standIn := newAPIStandIn(t,
+		scriptedResponse{http.StatusOK, `{"ok":true,"result":true}`},
+		scriptedResponse{http.StatusOK, `{"ok":true,"result":"unexpected"}`},
+		scriptedResponse{http.StatusBadGateway, `<html>Bad Gateway</html>`},
+	)
+	client := tgClient{standIn.URL, "token"}
+
+	err := client.DeleteMessage(42, 7)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = client.SendMessage(tgMessage{42, "text", ""})
+	if err == nil {
+		t.Error("Expected error for unexpected result")
+	}
+	_, err = client.SendMessage(tgMessage{42, "text", ""})
+	if err == nil || err.Error() != "Bad response: 502 <html>Bad Gateway</html>" {
+		t.Errorf("Expected error for non-JSON response, got %v", err)
+	}
+}
+
+func TestTGRetryAfter(t *testing.T) {
+	standIn := newAPIStandIn(t,
+		scriptedResponse{http.StatusTooManyRequests, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 5","parameters":{"retry_after":5}}`},
+		scriptedResponse{http.StatusOK, `{"ok":true,"result":{"message_id":7}}`},
+	)
+	sent, err := tgClient{standIn.URL, "token"}.SendMessage(tgMessage{42, "text", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.MessageID != 7 || len(standIn.calls) != 2 || standIn.calls[0] != standIn.calls[1] {
+		t.Errorf("Expected message to be sent again, got %v after %v", sent, standIn.calls)
+	}
+}
+
+func TestTGErrors(t *testing.T) {
+	standIn := newAPIStandIn(t,
+		scriptedResponse{http.StatusTooManyRequests, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 3600","parameters":{"retry_after":3600}}`},
+	)
+	_, err := tgClient{standIn.URL, "token"}.SendMessage(tgMessage{42, "text", ""})
+	if err == nil || len(standIn.calls) != 1 {
+		t.Errorf("Expected long flood wait to fail at once, got %v after %d requests", err, len(standIn.calls))
+	}
+
+	standIn = newAPIStandIn(t,
+		scriptedResponse{http.StatusBadRequest, `{"ok":false,"error_code":400,"description":"Bad Request: group chat was upgraded to a supergroup chat","parameters":{"migrate_to_chat_id":-1001234}}`},
+	)
+	_, err = tgClient{standIn.URL, "token"}.SendMessage(tgMessage{42, "text", ""})
+	if migrated := tgMigratedChat(err); migrated != -1001234 || len(standIn.calls) != 1 {
+		t.Errorf("Expected chat migration, got %v", err)
+	}
+
+	standIn = newAPIStandIn(t, scriptedResponse{http.StatusBadRequest, `{"ok":false,"error_code":400,"description":"Bad Request: can't parse entities"}`})
+	_, err = tgClient{standIn.URL, "token"}.SendMessage(tgMessage{42, "text", ""})
+	if err == nil || err.Error() != "Bad response: 400 Bad Request: can't parse entities" || tgMigratedChat(err) != 0 {
+		t.Errorf("Expected API error description, got %v", err)
+	}
+}
+
+func TestAPIBaseURL(t *testing.T) {
+	standIn := newAPIStandIn(t,
+		scriptedResponse{http.StatusOK, `{"ok":true,"result":true}`},
+		scriptedResponse{http.StatusOK, `{"success":true}`},
+	)
+	defaultTG, defaultTT := tgBaseURL, ttBaseURL
+	tgBaseURL, ttBaseURL = standIn.URL, standIn.URL+"/tt"
+	defer func() { tgBaseURL, ttBaseURL = defaultTG, defaultTT }()
+
+	err := tgDelete(Delivery{Chat: 42, MessageIDs: []string{"7"}}, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ttDelete(Delivery{Chat: 42, MessageIDs: []string{"mid.7"}}, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if standIn.calls[0].Path != "/bottoken/deleteMessage" || standIn.calls[1].Path != "/tt/messages?access_token=token&message_id=mid.7" {
+		t.Errorf("Unexpected requests %v", standIn.calls)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, standIn.URL+"/bottoken/sendMessage", nil)
+	if dryRunService(req) != "tg" {
+		t.Error("Requests to local Bot API server should be faked in dry-run mode")
+	}
+}
+
+func TestTGSendPhoto(t *testing.T) {
+	standIn := newAPIStandIn(t, scriptedResponse{http.StatusOK, `{"ok":true,"result":{"message_id":7}}`})
+	image := noiseImage(64, 48)
+	imageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.jpg":
+			w.Write(image)
+		case "/moved.jpg":
+			w.Write([]byte("<html><body>Page moved</body></html>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer imageServer.Close()
+	client := tgClient{standIn.URL, "token"}
+
+	id, err := tgSendPhoto(client, 42, "caption", imageServer.URL+"/image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := standIn.calls[0]
+	if id != "7" || len(standIn.calls) != 1 || !strings.HasPrefix(call.ContentType, "multipart/form-data") ||
+		!strings.Contains(call.Body, `name="photo"; filename="image.jpg"`) || !strings.Contains(call.Body, string(image)) {
+		t.Errorf("Expected photo to be uploaded, got %v", standIn.calls)
+	}
+
+	// NASA is unavailable for the bot, Telegram may still fetch it
+	id, err = tgSendPhoto(client, 42, "caption", imageServer.URL+"/missing.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	call = standIn.calls[1]
+	if id != "7" || call.ContentType != "application/json" || !strings.Contains(call.Body, `"photo":"`+imageServer.URL+`/missing.jpg"`) {
+		t.Errorf("Expected URL fallback, got %v", call)
+	}
+
+	// Telegram would get the same page
+	_, err = tgSendPhoto(client, 42, "caption", imageServer.URL+"/moved.jpg")
+	if !errors.Is(err, errInvalidMedia) || len(standIn.calls) != 2 {
+		t.Errorf("Expected invalid media without fallback, got %v after %v", err, standIn.calls)
+	}
+}
+
+func TestTGSendFullImage(t *testing.T) {
+	standIn := newAPIStandIn(t, scriptedResponse{http.StatusOK, `{"ok":true,"result":{"message_id":7}}`})
+	preview := noiseImage(64, 48)
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	imageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/preview.jpg":
+			w.Write(preview)
+		case "/full.tif":
+			w.Write(tiff)
+		case "/chunked.tif":
+			// Length is unknown
+			w.(http.Flusher).Flush()
+			w.Write(tiff)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer imageServer.Close()
+	defaultURL := tgBaseURL
+	tgBaseURL = standIn.URL
+	defer func() { tgBaseURL = defaultURL }()
+	defaultLimits := tgDocumentLimits
+	defer func() { tgDocumentLimits = defaultLimits }()
+
+	p := postedPicture()
+	p.URL = imageServer.URL + "/preview.jpg"
+	tests := []struct {
+		file      string
+		maxLength int64
+		document  bool
+	}{
+		{"/full.tif", 1024, true},
+		{"/full.tif", 4, false},
+		{"/chunked.tif", 4, true},
+	}
+	for _, test := range tests {
+		standIn.calls = nil
+		tgDocumentLimits = mediaLimits{MaxLength: test.maxLength}
+		p.FullImageURL = imageServer.URL + test.file
+		messages, err := tgSendPicture(p, "token", 42)
+		if err != nil {
+			t.Errorf("%s: %v", test.file, err)
+			continue
+		}
+		if sent := len(messages) == 2; sent != test.document {
+			t.Errorf("%s within %d bytes: expected document %v, got %v", test.file, test.maxLength, test.document, messages)
+		}
+		if test.document && !strings.Contains(standIn.calls[len(standIn.calls)-1].Body, string(tiff)) {
+			t.Errorf("%s: TIFF should be sent as is", test.file)
+		}
+	}
+}
+
+func TestTGSendDocumentRetryAfter(t *testing.T) {
+	standIn := newAPIStandIn(t,
+		scriptedResponse{http.StatusTooManyRequests, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 1","parameters":{"retry_after":1}}`},
+		scriptedResponse{http.StatusOK, `{"ok":true,"result":{"message_id":7}}`},
+	)
+	var downloads int
+	fileServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		// Length is unknown, the upload is streamed
+		w.(http.Flusher).Flush()
+		w.Write([]byte("II*\x00\x08\x00\x00\x00"))
+	}))
+	defer fileServer.Close()
+
+	id, err := tgSendDocument(tgClient{standIn.URL, "token"}, 42, "caption", fileServer.URL+"/full.tif")
+	if err != nil || id != "7" {
+		t.Fatalf("Expected document to be sent again, got %q (%v)", id, err)
+	}
+	if downloads != 2 || standIn.calls[0].ContentLength != -1 {
+		t.Errorf("Expected streamed file to be downloaded again, got %d downloads", downloads)
+	}
+}
+
+func TestTGSendOther(t *testing.T) {
+	transport := recordRequests(t, `{"ok":true,"result":{"message_id":7}}`)
+	p := postedPicture()
+	p.MediaType, p.URL, p.FullImageURL = mediaTypeOther, "", ""
+
+	messages, err := tgSendOther(p, "token", 42)
+	if err != nil || len(messages) != 1 || messages[0].Kind != messageKindText {
+		t.Fatalf("Expected text message, got %v (%v)", messages, err)
+	}
+	request := transport.requests[0]
+	if !strings.HasSuffix(request.URL, "/sendMessage") || !strings.HasSuffix(request.Body["text"].(string), "🔗 [Open](https://apod.nasa.gov/apod/ap200128.html)") {
+		t.Errorf("Unexpected request %v", request)
+	}
+
+	transport.requests = nil
+	transport.media = noiseImage(64, 48)
+	p.ThumbnailURL = "https://apod.nasa.gov/apod/image/0308/marsrotates.jpg"
+	messages, err = tgSendOther(p, "token", 42)
+	if err != nil || len(messages) != 1 || messages[0].Kind != messageKindPhoto {
+		t.Fatalf("Expected preview, got %v (%v)", messages, err)
+	}
+	if url := transport.requests[len(transport.requests)-1].URL; !strings.HasSuffix(url, "/sendPhoto") {
+		t.Errorf("Expected preview upload, got %s", url)
+	}
+}
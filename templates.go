@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Message templates, every destination can override them
+// with <name>.tmpl files from -templates directory
+const (
+	templatePhoto     = "photo"      // image, animation or video file caption
+	templateVideo     = "video"      // embedded video thumbnail caption
+	templateVideoText = "video_text" // embedded video without thumbnail
+	templateDocument  = "document"   // full resolution image caption
+	templateOther     = "other"      // interactive content text or its preview caption
+)
+
+var tgDefaultTemplates = map[string]string{
+	templatePhoto:     "*{{.Title}}*\n{{firstSentences 2 .Explanation}}…\n{{.Link}}",
+	templateVideo:     "*{{.Title}}*\n{{firstSentences 2 .Explanation}}…\n▶️ [Watch]({{watchURL .URL}})",
+	templateVideoText: "[{{.Title}}]({{watchURL .URL}})\n{{.Explanation}}",
+	templateDocument:  "{{with .Copyright}}© {{.}}{{end}}",
+	templateOther:     "*{{.Title}}*\n{{firstSentences 2 .Explanation}}…\n🔗 [Open]({{.Link}})",
+}
+
+var ttDefaultTemplates = map[string]string{
+	templatePhoto:     "🌌{{.Title}}\n\n{{.Explanation}}\n🔗 {{.Link}}",
+	templateVideo:     "🌌{{.Title}}\n\n{{.Explanation}}\n▶️ {{watchURL .URL}}",
+	templateVideoText: "🌌{{.Title}}\n\n{{.Explanation}}\n▶️ {{watchURL .URL}}",
+	templateDocument:  "{{with .Copyright}}© {{.}}{{end}}",
+	templateOther:     "🌌{{.Title}}\n\n{{.Explanation}}\n🔗 {{.Link}}",
+}
+
+var templateFuncs = template.FuncMap{
+	"truncate":       truncate,
+	"firstSentences": func(count int, s string) string { return firstSentences(s, count) },
+	"escape":         escapeMarkdown,
+	"hashtags":       hashtags,
+	"date":           formatDate,
+	"watchURL":       watchURL,
+}
+
+var (
+	tgTemplates = mustParseTemplates(tgDefaultTemplates)
+	ttTemplates = mustParseTemplates(ttDefaultTemplates)
+)
+
+func mustParseTemplates(sources map[string]string) *template.Template {
+	templates := template.New("").Funcs(templateFuncs)
+	for name, source := range sources {
+		template.Must(templates.New(name).Parse(source))
+	}
+	return templates
+}
+
+// loadTemplates overrides default templates with <name>.tmpl files from the directory
+func loadTemplates(templates *template.Template, directoryPath string) (*template.Template, error) {
+	files, err := filepath.Glob(filepath.Join(directoryPath, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	templates, err = templates.Clone()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".tmpl")
+		if templates.Lookup(name) == nil {
+			return nil, fmt.Errorf("Unknown template %s", file)
+		}
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		// Editors usually add a trailing new line
+		_, err = templates.New(name).Parse(strings.TrimSuffix(string(body), "\n"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Execution errors, e.g. wrong function arguments, would otherwise show up only when posting
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".tmpl")
+		err = templates.ExecuteTemplate(ioutil.Discard, name, sampleTemplatePicture)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return templates, nil
+}
+
+// sampleTemplatePicture has every field templates may use
+var sampleTemplatePicture = picture{
+	Copyright:    "Francesco Antonucci",
+	Date:         "2020-01-28",
+	Explanation:  "What's all of the commotion in the Tadpole Nebula? Star formation.",
+	Title:        "Star Formation in the Tadpole Nebula",
+	MediaType:    mediaTypeImage,
+	FullImageURL: "https://apod.nasa.gov/apod/image/2001/ic410_WISEantonucci_1824.jpg",
+	URL:          "https://apod.nasa.gov/apod/image/2001/ic410_WISEantonucci_960.jpg",
+	ThumbnailURL: "https://apod.nasa.gov/apod/image/2001/ic410_WISEantonucci_960.jpg",
+	Link:         "https://apod.nasa.gov/apod/ap200128.html",
+}
+
+func renderTemplate(templates *template.Template, name string, p picture) string {
+	var b bytes.Buffer
+	err := templates.ExecuteTemplate(&b, name, p)
+	if err != nil {
+		logError("Can't render template", name, err)
+	}
+	return b.String()
+}
+
+// truncate cuts s to at most length runes, adding ellipsis if it was cut
+func truncate(length int, s string) string {
+	if length <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= length {
+		return s
+	}
+	runes := []rune(s)
+	return strings.TrimSpace(string(runes[:length-1])) + "…"
+}
+
+// escapeMarkdown escapes Telegram legacy Markdown entities
+func escapeMarkdown(s string) string {
+	replacer := strings.NewReplacer("_", "\\_", "*", "\\*", "`", "\\`", "[", "\\[")
+	return replacer.Replace(s)
+}
+
+// hashtags turns words into hashtags: "Tadpole Nebula" becomes "#Tadpole #Nebula"
+func hashtags(s string) string {
+	var tags []string
+	seen := map[string]bool{}
+	for _, word := range strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	}) {
+		if utf8.RuneCountInString(word) < 3 || seen[strings.ToLower(word)] {
+			continue
+		}
+		seen[strings.ToLower(word)] = true
+		tags = append(tags, "#"+word)
+	}
+	return strings.Join(tags, " ")
+}
+
+// formatDate formats APOD date (2006-01-02) with the given layout
+func formatDate(layout string, date string) string {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return date
+	}
+	return t.Format(layout)
+}
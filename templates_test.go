@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultTemplates(t *testing.T) {
+	p := postedPicture()
+	p.Explanation = "What's all of the commotion? Star formation. Dusty emission."
+
+	tests := []struct {
+		result   string
+		expected string
+	}{
+		{tgPictureCaption(p), "*Star Formation in the Tadpole Nebula*\nWhat's all of the commotion? Star formation…\nhttps://apod.nasa.gov/apod/ap200128.html"},
+		{tgDocumentCaption(p), "© Francesco Antonucci"},
+		{ttPictureText(p), "🌌Star Formation in the Tadpole Nebula\n\nWhat's all of the commotion? Star formation. Dusty emission.\n🔗 https://apod.nasa.gov/apod/ap200128.html"},
+		{ttDocumentCaption(picture{}), ""},
+		{ttOtherText(p), "🌌Star Formation in the Tadpole Nebula\n\nWhat's all of the commotion? Star formation. Dusty emission.\n🔗 https://apod.nasa.gov/apod/ap200128.html"},
+	}
+	for _, test := range tests {
+		if test.result != test.expected {
+			t.Errorf("Expected\n%q\ngot\n%q", test.expected, test.result)
+		}
+	}
+
+	video := picture{Title: "Parker", Explanation: "Sounds.", URL: "https://www.youtube.com/embed/hgzGET6owYk?rel=0"}
+	if text := tgVideoText(video); text != "[Parker](https://www.youtube.com/watch?v=hgzGET6owYk)\nSounds." {
+		t.Errorf("Unexpected video text %q", text)
+	}
+}
+
+func TestLoadTemplates(t *testing.T) {
+	dir := t.TempDir()
+	source := "{{date \"2 January\" .Date}}: {{escape .Title}} {{truncate 10 .Explanation}} {{hashtags .Title}}\n"
+	err := ioutil.WriteFile(filepath.Join(dir, "photo.tmpl"), []byte(source), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := loadTemplates(tgTemplates, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := picture{Date: "2020-01-28", Title: "IC_410 in the Tadpole", Explanation: "What's all of the commotion?"}
+	result := renderTemplate(templates, templatePhoto, p)
+	expected := "28 January: IC\\_410 in the Tadpole What's al… #IC_410 #the #Tadpole"
+	if result != expected {
+		t.Errorf("Expected\n%q\ngot\n%q", expected, result)
+	}
+	if renderTemplate(tgTemplates, templatePhoto, p) == result {
+		t.Error("Default templates shouldn't be changed")
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "unknown.tmpl"), []byte(source), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadTemplates(tgTemplates, dir); err == nil {
+		t.Error("Unknown template should be an error")
+	}
+	os.Remove(filepath.Join(dir, "unknown.tmpl"))
+
+	err = ioutil.WriteFile(filepath.Join(dir, "photo.tmpl"), []byte("{{truncate .Title 10}}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadTemplates(tgTemplates, dir); err == nil {
+		t.Error("Template failing to execute should be an error")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		length   int
+		s        string
+		expected string
+	}{
+		{10, "Tadpole", "Tadpole"},
+		{5, "Tadpole Nebula", "Tadp…"},
+		{1, "Tadpole", "…"},
+		{0, "Tadpole", ""},
+		{-1, "Tadpole", ""},
+	}
+	for _, test := range tests {
+		if result := truncate(test.length, test.s); result != test.expected {
+			t.Errorf("truncate(%d, %q): expected %q, got %q", test.length, test.s, test.expected, result)
+		}
+	}
+}
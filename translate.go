@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// APOD is published in English
+const sourceLanguage = "en"
+
+var errTranslationNotFound = errors.New("Translation not found")
+
+// Translation is a translated title and explanation of an APOD
+type Translation struct {
+	Title       string
+	Explanation string
+	// Checksum of the original text, cached translation is stale if NASA edits the picture
+	Checksum string `json:",omitempty"`
+}
+
+// Translator translates picture texts into the language
+type Translator interface {
+	Translate(p picture, language string) (Translation, error)
+}
+
+// Captions are translated into captionLanguage if it's set
+var (
+	translator      Translator
+	captionLanguage string
+)
+
+// translatePicture returns the picture with translated texts or the original one if translation fails
+func translatePicture(p picture) picture {
+	if translator == nil || len(captionLanguage) == 0 || captionLanguage == sourceLanguage {
+		return p
+	}
+	translation, err := translator.Translate(p, captionLanguage)
+	if err != nil {
+		logWarning("Can't translate", p.Date, "into", captionLanguage, err)
+		return p
+	}
+	fmt.Println("Translated into", captionLanguage)
+	p.Title = translation.Title
+	p.Explanation = translation.Explanation
+	return p
+}
+
+func textChecksum(p picture) string {
+	sum := sha1.Sum([]byte(p.Title + "\n" + p.Explanation))
+	return hex.EncodeToString(sum[:])
+}
+
+// libreTranslator uses LibreTranslate compatible API
+type libreTranslator struct {
+	URL    string
+	APIKey string
+}
+
+type libreTranslateRequest struct {
+	Q      string `json:"q"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Format string `json:"format"`
+	APIKey string `json:"api_key,omitempty"`
+}
+
+type libreTranslateResponse struct {
+	TranslatedText string `json:"translatedText"`
+	Error          string `json:"error"`
+}
+
+func (t libreTranslator) Translate(p picture, language string) (Translation, error) {
+	title, err := t.translateText(p.Title, language)
+	if err != nil {
+		return Translation{}, err
+	}
+	explanation, err := t.translateText(p.Explanation, language)
+	if err != nil {
+		return Translation{}, err
+	}
+	return Translation{Title: title, Explanation: explanation}, nil
+}
+
+func (t libreTranslator) translateText(text string, language string) (string, error) {
+	request := libreTranslateRequest{text, sourceLanguage, language, "text", t.APIKey}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpPost(strings.TrimSuffix(t.URL, "/")+"/translate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	err = checkResponseStatus(resp)
+	if err != nil {
+		return "", err
+	}
+	var response libreTranslateResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return "", err
+	}
+	if len(response.Error) > 0 {
+		return "", errors.New(response.Error)
+	}
+	if len(response.TranslatedText) == 0 && len(text) > 0 {
+		return "", errors.New("Empty translation")
+	}
+	return response.TranslatedText, nil
+}
+
+// overrideTranslator takes manual translations from a JSON file:
+// {"2023-01-28": {"ru": {"Title": "...", "Explanation": "..."}}}
+// and asks the next translator for missing ones
+type overrideTranslator struct {
+	FilePath string
+	Next     Translator
+}
+
+func (t overrideTranslator) Translate(p picture, language string) (Translation, error) {
+	data, err := ioutil.ReadFile(t.FilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return Translation{}, err
+	}
+	if err == nil {
+		var overrides map[string]map[string]Translation
+		err = json.Unmarshal(data, &overrides)
+		if err != nil {
+			return Translation{}, fmt.Errorf("Broken translations file %s: %w", t.FilePath, err)
+		}
+		translation, ok := overrides[p.Date][language]
+		if ok {
+			fmt.Println("Using manual translation from", t.FilePath)
+			return translation, nil
+		}
+	}
+	if t.Next == nil {
+		return Translation{}, errTranslationNotFound
+	}
+	return t.Next.Translate(p, language)
+}
+
+// cachedTranslator keeps translations in the state store by APOD date
+type cachedTranslator struct {
+	Store   stateStore
+	Service string
+	Next    Translator
+}
+
+func (t cachedTranslator) Translate(p picture, language string) (Translation, error) {
+	checksum := textChecksum(p)
+	var cached Translation
+	err := t.Store.View(func(tx stateTx) error {
+		var err error
+		cached, err = tx.Translation(t.Service, p.Date, language)
+		return err
+	})
+	if err != nil {
+		return Translation{}, err
+	}
+	if len(cached.Explanation) > 0 && cached.Checksum == checksum {
+		fmt.Println("Using cached translation")
+		return cached, nil
+	}
+
+	translation, err := t.Next.Translate(p, language)
+	if err != nil {
+		return Translation{}, err
+	}
+	translation.Checksum = checksum
+	err = t.Store.Update(func(tx stateTx) error {
+		return tx.SetTranslation(t.Service, p.Date, language, translation)
+	})
+	if err != nil {
+		logWarning("Can't cache translation:", err)
+	}
+	return translation, nil
+}
+
+func translationKey(date string, language string) string {
+	return date + "/" + language
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// libreTranslateStandIn translates by prefixing text with the target language
+func libreTranslateStandIn(t *testing.T, requests *int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		var request libreTranslateRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || r.URL.Path != "/translate" || request.Source != "en" || request.APIKey != "key" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"bad request"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(libreTranslateResponse{TranslatedText: request.Target + ": " + request.Q})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLibreTranslator(t *testing.T) {
+	var requests int
+	server := libreTranslateStandIn(t, &requests)
+
+	translation, err := libreTranslator{server.URL + "/", "key"}.Translate(postedPicture(), "ru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if translation.Title != "ru: Star Formation in the Tadpole Nebula" ||
+		translation.Explanation != "ru: What's all of the commotion in the Tadpole Nebula? Star formation." {
+		t.Errorf("Unexpected translation %v", translation)
+	}
+
+	_, err = libreTranslator{server.URL, "wrong"}.Translate(postedPicture(), "ru")
+	if err == nil {
+		t.Error("Expected error for rejected request")
+	}
+}
+
+func TestCachedTranslator(t *testing.T) {
+	fullConfigFilePath = "test-config.json"
+	defer os.Remove(fullConfigFilePath)
+	defer os.Remove(fullConfigFilePath + ".lock")
+
+	var requests int
+	server := libreTranslateStandIn(t, &requests)
+	translator := cachedTranslator{jsonStore{}, "tt", libreTranslator{server.URL, "key"}}
+
+	p := postedPicture()
+	first, err := translator.Translate(p, "ru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := translator.Translate(p, "ru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 || first != second {
+		t.Errorf("Expected cached translation, got %d requests", requests)
+	}
+
+	_, err = translator.Translate(p, "de")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 4 {
+		t.Errorf("Expected translation per language, got %d requests", requests)
+	}
+
+	p.Title = "Star Formation in the Tadpole"
+	edited, err := translator.Translate(p, "ru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 6 || edited.Title != "ru: Star Formation in the Tadpole" {
+		t.Errorf("Expected edited picture to be translated again, got %v", edited)
+	}
+}
+
+func TestOverrideTranslator(t *testing.T) {
+	overrides := filepath.Join(t.TempDir(), "translations.json")
+	err := ioutil.WriteFile(overrides, []byte(`{"2020-01-28": {"ru": {"Title": "Звёзды", "Explanation": "Туманность"}}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int
+	server := libreTranslateStandIn(t, &requests)
+	translator := overrideTranslator{overrides, libreTranslator{server.URL, "key"}}
+
+	translation, err := translator.Translate(postedPicture(), "ru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if translation.Title != "Звёзды" || requests != 0 {
+		t.Errorf("Expected manual translation, got %v", translation)
+	}
+
+	translation, err = translator.Translate(postedPicture(), "de")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if translation.Title != "de: Star Formation in the Tadpole Nebula" {
+		t.Errorf("Expected fallback translation, got %v", translation)
+	}
+
+	_, err = overrideTranslator{overrides, nil}.Translate(postedPicture(), "de")
+	if err != errTranslationNotFound {
+		t.Errorf("Expected %v, got %v", errTranslationNotFound, err)
+	}
+}
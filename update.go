@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	messageKindPhoto     = "photo"
+	messageKindAnimation = "animation"
+	messageKindVideo     = "video"
+	messageKindDocument  = "document"
+	messageKindText      = "text"
+)
+
+// sentMessage is a posted message and what it contains
+type sentMessage struct {
+	ID   string
+	Kind string
+}
+
+// findDeliveries returns deliveries to the chat for the date or the latest one if date is empty
+func findDeliveries(store stateStore, service string, chat int64, date string) ([]Delivery, error) {
+	var found []Delivery
+	err := store.View(func(tx stateTx) error {
+		deliveries, err := tx.Deliveries(service)
+		if err != nil {
+			return err
+		}
+		for _, delivery := range deliveries {
+			if delivery.Chat != chat {
+				continue
+			}
+			if len(date) == 0 {
+				found = []Delivery{delivery}
+			} else if delivery.Date == date {
+				found = append(found, delivery)
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// updateDelivery fetches the picture again and edits posted messages if NASA changed it
+func updateDelivery(store stateStore, delivery Delivery, token string) error {
+	if len(delivery.Picture.Date) == 0 {
+		return fmt.Errorf("Posted picture isn't recorded for %s", delivery.Date)
+	}
+
+	pictureTime, err := time.Parse("2006-01-02", delivery.Date)
+	if err != nil {
+		return err
+	}
+	var updated picture
+	source, err := fetchPicture(&updated, pictureTime)
+	if err != nil {
+		return err
+	}
+	updated.Link = pictureURL(updated, pictureTime)
+	if source == sourceHTML && delivery.Source != sourceHTML {
+		// HTML page doesn't have these, their absence isn't an edit
+		if len(updated.Copyright) == 0 {
+			updated.Copyright = delivery.Picture.Copyright
+		}
+		if len(updated.ThumbnailURL) == 0 {
+			updated.ThumbnailURL = delivery.Picture.ThumbnailURL
+		}
+	}
+
+	if updated == delivery.Picture {
+		fmt.Println("Picture hasn't changed since", delivery.SentAt)
+	} else if updated.MediaType != delivery.Picture.MediaType {
+		return errors.New("Media type changed from " + delivery.Picture.MediaType + " to " + updated.MediaType + ", retract and post again")
+	} else {
+		// Delivery keeps the original picture, captions are compared translated
+		posted := delivery
+		posted.Picture = translatePicture(delivery.Picture)
+		switch delivery.Service {
+		case "tg":
+			err = tgUpdate(posted, translatePicture(updated), token)
+		default:
+			err = ttUpdate(posted, translatePicture(updated), token)
+		}
+		if err != nil {
+			return err
+		}
+		delivery.Picture = updated
+	}
+
+	delivery.CheckedAt = time.Now()
+	return store.Update(func(tx stateTx) error {
+		return tx.UpdateDelivery(delivery)
+	})
+}
+
+// recheckLatest updates the latest delivery once, when it's older than delay
+func recheckLatest(store stateStore, service string, chat int64, delay time.Duration, token string) error {
+	deliveries, err := findDeliveries(store, service, chat, "")
+	if err != nil || len(deliveries) == 0 {
+		return err
+	}
+	delivery := deliveries[0]
+	if !delivery.CheckedAt.IsZero() || len(delivery.Picture.Date) == 0 || time.Since(delivery.SentAt) < delay {
+		return nil
+	}
+	fmt.Println("Rechecking picture posted at", delivery.SentAt)
+	return updateDelivery(store, delivery, token)
+}
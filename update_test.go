@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTGUpdate(t *testing.T) {
+	transport := recordRequests(t, `{"ok":true,"result":{"message_id":1}}`)
+
+	delivery := Delivery{
+		Service:      "tg",
+		Chat:         42,
+		MessageIDs:   []string{"10", "11"},
+		MessageKinds: []string{messageKindPhoto, messageKindDocument},
+		Picture:      postedPicture(),
+	}
+	updated := delivery.Picture
+	updated.Title = "Star Formation in the Tadpole"
+	err := tgUpdate(delivery, updated, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.requests) != 1 {
+		t.Fatalf("Expected one edit, got %v", transport.requests)
+	}
+	request := transport.requests[0]
+	if !strings.HasSuffix(request.URL, "/editMessageCaption") || request.Body["message_id"] != 10.0 {
+		t.Errorf("Unexpected request %v", request)
+	}
+	if !strings.HasPrefix(request.Body["caption"].(string), "*Star Formation in the Tadpole*") {
+		t.Errorf("Unexpected caption %v", request.Body["caption"])
+	}
+
+	transport.requests = nil
+	updated.FullImageURL = "https://apod.nasa.gov/apod/image/2001/ic410_WISEantonucci_2048.jpg"
+	delivery.Picture.Title = updated.Title
+	err = tgUpdate(delivery, updated, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.requests) != 1 {
+		t.Fatalf("Expected one edit, got %v", transport.requests)
+	}
+	request = transport.requests[0]
+	media := request.Body["media"].(map[string]interface{})
+	if !strings.HasSuffix(request.URL, "/editMessageMedia") || request.Body["message_id"] != 11.0 || media["media"] != updated.FullImageURL {
+		t.Errorf("Unexpected request %v", request)
+	}
+
+	// Document stays when hdurl disappears
+	transport.requests = nil
+	delivery.Picture = updated
+	updated.FullImageURL = ""
+	err = tgUpdate(delivery, updated, "token")
+	if err != nil || len(transport.requests) != 0 {
+		t.Errorf("Expected no edits, got %v (%v)", transport.requests, err)
+	}
+}
+
+func TestTTUpdate(t *testing.T) {
+	transport := recordRequests(t, `{"success":true}`)
+
+	delivery := Delivery{
+		Service:      "tt",
+		Chat:         42,
+		MessageIDs:   []string{"mid.1", "mid.2"},
+		MessageKinds: []string{messageKindPhoto, messageKindDocument},
+		Picture:      postedPicture(),
+	}
+	updated := delivery.Picture
+	updated.Explanation = "Star formation."
+	err := ttUpdate(delivery, updated, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.requests) != 1 {
+		t.Fatalf("Expected one edit, got %v", transport.requests)
+	}
+	request := transport.requests[0]
+	if request.Method != http.MethodPut || !strings.Contains(request.URL, "message_id=mid.1") {
+		t.Errorf("Unexpected request %v", request)
+	}
+	if _, ok := request.Body["attachments"]; ok {
+		t.Error("Attachments shouldn't be changed")
+	}
+	if request.Body["text"] != ttPictureText(updated) {
+		t.Errorf("Unexpected text %v", request.Body["text"])
+	}
+}
+
+func TestRetract(t *testing.T) {
+	fullConfigFilePath = "test-config.json"
+	defer os.Remove(fullConfigFilePath)
+	defer os.Remove(fullConfigFilePath + ".lock")
+	store := jsonStore{}
+
+	for _, delivery := range []Delivery{
+		{Date: "2020-01-27", Service: "tg", Chat: 42, MessageIDs: []string{"1", "2"}},
+		{Date: "2020-01-28", Service: "tg", Chat: 42, MessageIDs: []string{"3", "4"}},
+		{Date: "2020-01-28", Service: "tg", Chat: 43, MessageIDs: []string{"5"}},
+	} {
+		err := saveDelivery(store, delivery)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	transport := recordRequests(t, `{"ok":true,"result":true}`)
+	err := retract(store, "tg", "token", "2020-01-28")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deleted []string
+	for _, request := range transport.requests {
+		if !strings.HasSuffix(request.URL, "/deleteMessage") {
+			t.Error("Unexpected request", request.URL)
+		}
+		deleted = append(deleted, fmt.Sprint(request.Body["chat_id"], ":", request.Body["message_id"]))
+	}
+	// Chats are retracted concurrently, messages of a chat in order
+	sort.SliceStable(deleted, func(i, j int) bool {
+		return strings.Split(deleted[i], ":")[0] < strings.Split(deleted[j], ":")[0]
+	})
+	if strings.Join(deleted, ",") != "42:3,42:4,43:5" {
+		t.Error("Unexpected deleted messages", deleted)
+	}
+
+	lastDate, err := readLastSentDate(store, "tg")
+	if err != nil || lastDate != "2020-01-27" {
+		t.Errorf("Last date should be rolled back, got %s (%v)", lastDate, err)
+	}
+	deliveries, err := findDeliveries(store, "tg", 42, "")
+	if err != nil || len(deliveries) != 1 || deliveries[0].Date != "2020-01-27" {
+		t.Errorf("Unexpected deliveries %v (%v)", deliveries, err)
+	}
+}
+
+func TestRetractDeletedMessage(t *testing.T) {
+	fullConfigFilePath = "test-config.json"
+	defer os.Remove(fullConfigFilePath)
+	defer os.Remove(fullConfigFilePath + ".lock")
+	store := jsonStore{}
+	err := saveDelivery(store, Delivery{Date: "2020-01-28", Service: "tg", Chat: 42, MessageIDs: []string{"3", "4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	standIn := newAPIStandIn(t,
+		scriptedResponse{http.StatusBadRequest, `{"ok":false,"error_code":400,"description":"Bad Request: message to delete not found"}`},
+		scriptedResponse{http.StatusOK, `{"ok":true,"result":true}`},
+	)
+	defaultTG := tgBaseURL
+	tgBaseURL = standIn.URL
+	defer func() { tgBaseURL = defaultTG }()
+
+	err = retract(store, "tg", "token", "2020-01-28")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(standIn.calls) != 2 {
+		t.Errorf("Expected both messages to be deleted, got %v", standIn.calls)
+	}
+	deliveries, err := findDeliveries(store, "tg", 42, "")
+	if err != nil || len(deliveries) != 0 {
+		t.Errorf("Expected delivery to be rolled back, got %v (%v)", deliveries, err)
+	}
+}
+
+func TestPartialDelivery(t *testing.T) {
+	fullConfigFilePath = "test-config.json"
+	defer os.Remove(fullConfigFilePath)
+	defer os.Remove(fullConfigFilePath + ".lock")
+	store := jsonStore{}
+
+	send := func(p picture, token string, chat int64) ([]sentMessage, error) {
+		return []sentMessage{{"10", messageKindPhoto}}, errors.New("Document failed")
+	}
+	delivery := Delivery{Date: "2020-01-28", Service: "tg", Chat: 42, Picture: postedPicture()}
+	err := deliver(store, delivery, send, "token")
+	if err == nil {
+		t.Error("Expected send error")
+	}
+
+	deliveries, err := findDeliveries(store, "tg", 42, "")
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("Expected partial delivery, got %v (%v)", deliveries, err)
+	}
+	if saved := deliveries[0]; !saved.Partial || strings.Join(saved.MessageIDs, ",") != "10" || saved.MessageKinds[0] != messageKindPhoto {
+		t.Errorf("Unexpected delivery %v", saved)
+	}
+	lastDate, err := readLastSentDate(store, "tg")
+	if err != nil || lastDate != "2020-01-28" {
+		t.Errorf("Date shouldn't be posted again, got %s (%v)", lastDate, err)
+	}
+}
+
+func TestUpdateFromHTMLKeepsCopyright(t *testing.T) {
+	// API answers with something that isn't a picture, HTML page is used
+	transport := recordRequests(t, `{"ok":true,"result":{"message_id":1}}`)
+	page, err := ioutil.ReadFile("test_data/ap200128.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.media = page
+
+	var posted picture
+	err = makePictureFromHTML(bytes.NewReader(page), &posted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pictureTime, _ := time.Parse("2006-01-02", posted.Date)
+	posted.Link = pictureURL(posted, pictureTime)
+	posted.Copyright = "Francesco Antonucci"
+
+	delivery := Delivery{
+		ID:           1,
+		Date:         posted.Date,
+		Service:      "tg",
+		Chat:         42,
+		MessageIDs:   []string{"10", "11"},
+		MessageKinds: []string{messageKindPhoto, messageKindDocument},
+		Source:       sourceAPI,
+		Picture:      posted,
+	}
+	store := &memoryStore{map[string]Config{}}
+	err = store.Update(func(tx stateTx) error {
+		return tx.AddDelivery(delivery)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = updateDelivery(store, delivery, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range transport.requests {
+		if strings.Contains(request.URL, "/edit") {
+			t.Error("Unexpected edit", request.URL, request.RawBody)
+		}
+	}
+	deliveries, _ := findDeliveries(store, "tg", 42, posted.Date)
+	if len(deliveries) != 1 || deliveries[0].Picture.Copyright != posted.Copyright {
+		t.Errorf("Copyright should be kept, got %v", deliveries)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	videoHostYouTube     = "youtube"
+	videoHostVimeo       = "vimeo"
+	videoHostDailymotion = "dailymotion"
+)
+
+// Embed player parameters which make no sense for a shared link
+var videoURLJunkParameters = map[string]bool{
+	"autoplay": true, "autopause": true, "mute": true, "muted": true, "loop": true,
+	"rel": true, "controls": true, "showinfo": true, "modestbranding": true,
+	"playsinline": true, "enablejsapi": true, "origin": true, "iv_load_policy": true,
+	"title": true, "byline": true, "portrait": true, "badge": true, "app_id": true,
+	"player_id": true, "feature": true, "si": true, "fbclid": true, "gclid": true,
+}
+
+var (
+	youtubeThumbnailTemplate = "https://img.youtube.com/vi/%s/%s.jpg"
+	vimeoOEmbedTemplate      = "https://vimeo.com/api/oembed.json?url=%s"
+)
+
+// embeddedVideo parses an embed URL and returns video hosting and video ID
+func embeddedVideo(embedURL string) (string, string) {
+	u, err := url.Parse(embedURL)
+	if err != nil {
+		return "", ""
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	last := segments[len(segments)-1]
+
+	switch host {
+	case "youtube.com", "m.youtube.com", "youtube-nocookie.com":
+		if len(segments) == 2 && (segments[0] == "embed" || segments[0] == "v" || segments[0] == "shorts") {
+			return videoHostYouTube, last
+		}
+		if id := u.Query().Get("v"); len(id) > 0 {
+			return videoHostYouTube, id
+		}
+	case "youtu.be":
+		if len(last) > 0 {
+			return videoHostYouTube, last
+		}
+	case "vimeo.com", "player.vimeo.com":
+		if isNumeric(last) {
+			return videoHostVimeo, last
+		}
+	case "dailymotion.com", "geo.dailymotion.com":
+		if len(segments) >= 2 && segments[len(segments)-2] == "video" {
+			return videoHostDailymotion, last
+		}
+		if id := u.Query().Get("video"); len(id) > 0 {
+			return videoHostDailymotion, id
+		}
+	case "dai.ly":
+		if len(last) > 0 {
+			return videoHostDailymotion, last
+		}
+	}
+	return "", ""
+}
+
+// watchURL converts video embed URL to a canonical link which opens
+// a normal video page and gets a proper link preview
+func watchURL(embedURL string) string {
+	u, err := url.Parse(strings.TrimSpace(embedURL))
+	if err != nil {
+		return embedURL
+	}
+	if len(u.Scheme) == 0 || u.Scheme == "http" {
+		u.Scheme = "https"
+	}
+	query := u.Query()
+
+	host, id := embeddedVideo(u.String())
+	switch host {
+	case videoHostYouTube:
+		watch := "https://www.youtube.com/watch?v=" + url.QueryEscape(id)
+		if start := query.Get("start"); isNumeric(start) {
+			watch += "&t=" + start + "s"
+		} else if start := query.Get("t"); len(start) > 0 {
+			watch += "&t=" + url.QueryEscape(start)
+		}
+		return watch
+	case videoHostVimeo:
+		watch := "https://vimeo.com/" + id
+		// Unlisted videos need privacy hash
+		if hash := query.Get("h"); len(hash) > 0 {
+			watch += "/" + url.PathEscape(hash)
+		}
+		return watch
+	case videoHostDailymotion:
+		return "https://www.dailymotion.com/video/" + url.PathEscape(id)
+	}
+
+	for key := range query {
+		if videoURLJunkParameters[strings.ToLower(key)] || strings.HasPrefix(strings.ToLower(key), "utm_") {
+			query.Del(key)
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func isNumeric(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// videoThumbnailURL returns preview image for embedded video
+func videoThumbnailURL(p picture) (string, error) {
+	if len(p.ThumbnailURL) > 0 {
+		return p.ThumbnailURL, nil
+	}
+	host, id := embeddedVideo(p.URL)
+	switch host {
+	case videoHostYouTube:
+		return youtubeThumbnailURL(id)
+	case videoHostVimeo:
+		return vimeoThumbnailURL(id)
+	}
+	return "", fmt.Errorf("Unknown video hosting: %s", p.URL)
+}
+
+func youtubeThumbnailURL(id string) (string, error) {
+	// maxresdefault doesn't exist for low resolution videos
+	for _, name := range []string{"maxresdefault", "hqdefault"} {
+		thumbnailURL := fmt.Sprintf(youtubeThumbnailTemplate, id, name)
+		resp, err := httpHead(thumbnailURL)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return thumbnailURL, nil
+		}
+	}
+	return "", errors.New("No YouTube thumbnail for " + id)
+}
+
+func vimeoThumbnailURL(id string) (string, error) {
+	oembedURL := fmt.Sprintf(vimeoOEmbedTemplate, url.QueryEscape("https://vimeo.com/"+id))
+	resp, err := httpGet(oembedURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	err = checkResponseStatus(resp)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var response struct {
+		ThumbnailURL string `json:"thumbnail_url"`
+	}
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return "", err
+	}
+	if len(response.ThumbnailURL) == 0 {
+		return "", errors.New("No Vimeo thumbnail for " + id)
+	}
+	return response.ThumbnailURL, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEmbeddedVideo(t *testing.T) {
+	tests := []struct {
+		url  string
+		host string
+		id   string
+	}{
+		{"https://www.youtube.com/embed/hgzGET6owYk?rel=0", videoHostYouTube, "hgzGET6owYk"},
+		{"https://www.youtube-nocookie.com/embed/hgzGET6owYk", videoHostYouTube, "hgzGET6owYk"},
+		{"https://www.youtube.com/watch?v=hgzGET6owYk", videoHostYouTube, "hgzGET6owYk"},
+		{"https://youtu.be/hgzGET6owYk", videoHostYouTube, "hgzGET6owYk"},
+		{"https://player.vimeo.com/video/76979871?title=0", videoHostVimeo, "76979871"},
+		{"https://vimeo.com/76979871", videoHostVimeo, "76979871"},
+		{"https://apod.nasa.gov/apod/image/0308/marsrotates.swf", "", ""},
+	}
+	for _, test := range tests {
+		host, id := embeddedVideo(test.url)
+		if host != test.host || id != test.id {
+			t.Errorf("%s: expected %s %s, got %s %s", test.url, test.host, test.id, host, id)
+		}
+	}
+}
+
+func TestVideoThumbnail(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/oembed"):
+			if r.URL.Query().Get("url") != "https://vimeo.com/76979871" {
+				http.NotFound(w, r)
+				return
+			}
+			f, err := openTestFile("vimeo-oembed-76979871.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			io.Copy(w, f)
+		case r.URL.Path == "/vi/hgzGET6owYk/hqdefault.jpg":
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	youtubeTemplate, vimeoTemplate := youtubeThumbnailTemplate, vimeoOEmbedTemplate
+	defer func() {
+		youtubeThumbnailTemplate, vimeoOEmbedTemplate = youtubeTemplate, vimeoTemplate
+	}()
+	youtubeThumbnailTemplate = server.URL + "/vi/%s/%s.jpg"
+	vimeoOEmbedTemplate = server.URL + "/oembed?url=%s"
+
+	tests := []struct {
+		picture  picture
+		expected string
+	}{
+		{picture{URL: "https://www.youtube.com/embed/hgzGET6owYk?rel=0"}, server.URL + "/vi/hgzGET6owYk/hqdefault.jpg"},
+		{picture{URL: "https://player.vimeo.com/video/76979871"}, "https://i.vimeocdn.com/video/452001751-8216e0571c251a09d7a8387550f3de9b15aa5a41f4a8f1d1fc5ca2f7d0a9e0b1-d_640"},
+		{picture{URL: "https://www.youtube.com/embed/other", ThumbnailURL: "https://img.youtube.com/vi/other/0.jpg"}, "https://img.youtube.com/vi/other/0.jpg"},
+	}
+	for _, test := range tests {
+		thumbnailURL, err := videoThumbnailURL(test.picture)
+		if err != nil {
+			t.Error(test.picture.URL, err)
+			continue
+		}
+		if thumbnailURL != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.picture.URL, test.expected, thumbnailURL)
+		}
+	}
+
+	_, err := videoThumbnailURL(picture{URL: "https://www.youtube.com/embed/missing"})
+	if err == nil {
+		t.Error("Missing thumbnail should return error")
+	}
+	_, err = videoThumbnailURL(picture{URL: fmt.Sprintf("%s/video.swf", server.URL)})
+	if err == nil {
+		t.Error("Unknown hosting should return error")
+	}
+}
+
+func TestWatchURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"https://www.youtube.com/embed/hgzGET6owYk?rel=0", "https://www.youtube.com/watch?v=hgzGET6owYk"},
+		{"//www.youtube.com/embed/hgzGET6owYk?autoplay=1&start=42", "https://www.youtube.com/watch?v=hgzGET6owYk&t=42s"},
+		{"https://www.youtube-nocookie.com/embed/hgzGET6owYk", "https://www.youtube.com/watch?v=hgzGET6owYk"},
+		{"https://player.vimeo.com/video/76979871?title=0&byline=0&portrait=0", "https://vimeo.com/76979871"},
+		{"https://player.vimeo.com/video/76979871?h=8272103f6e&app_id=122963", "https://vimeo.com/76979871/8272103f6e"},
+		{"https://www.dailymotion.com/embed/video/x7tgad0?autoplay=1", "https://www.dailymotion.com/video/x7tgad0"},
+		{"http://example.com/player?id=7&autoplay=1&utm_source=apod", "https://example.com/player?id=7"},
+	}
+	for _, test := range tests {
+		if result := watchURL(test.url); result != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.url, test.expected, result)
+		}
+	}
+}